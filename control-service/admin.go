@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo/v4"
+)
+
+// requireAdmin guards the admin API with the token of the ADMIN_TOKEN env
+// var. The admin API is not registered without it.
+func (s *server) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	return func(c echo.Context) error {
+		token := bearerToken(c)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			return c.JSON(http.StatusUnauthorized, echo.Map{
+				"error": "invalid admin token",
+			})
+		}
+		return next(c)
+	}
+}
+
+func (s *server) initializeAdminRoutes() {
+	if os.Getenv("ADMIN_TOKEN") == "" {
+		return
+	}
+	admin := s.server.Group("/service/control/admin", s.requireAdmin)
+	if s.etcdClient != nil {
+		admin.POST("/apikeys", s.handleAPIKeyCreate)
+		admin.DELETE("/apikeys/:id", s.handleAPIKeyDelete)
+		admin.GET("/images", s.handleImageList)
+		admin.PUT("/images/:language", s.handleImageUpdate)
+		admin.DELETE("/images/:language", s.handleImageReset)
+	}
+	admin.GET("/pools", s.handlePoolList)
+	admin.GET("/pools/:language", s.handlePoolGet)
+	admin.POST("/pools/:language/drain", s.handlePoolDrain)
+	admin.POST("/pools/:language/resume", s.handlePoolResume)
+	admin.POST("/pools/:language/recycle", s.handlePoolRecycle)
+	admin.PUT("/pools/:language/size", s.handlePoolResize)
+	if s.auditStore != nil {
+		admin.GET("/audit", s.handleAuditQuery)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	API_KEY_PREFIX = "apikeys/"
+	// API_KEY_TOKEN_PREFIX makes the keys recognizable, e.g. for secret
+	// scanners.
+	API_KEY_TOKEN_PREFIX  = "tpw_"
+	API_KEY_MAX_NAME_SIZE = 100
+
+	apiKeyContextKey = "apiKey"
+)
+
+var errAPIKeyNotFound = errors.New("no api key found")
+
+// APIKey allows to call the run API without solving a Turnstile challenge.
+// Only the SHA-256 hash of the key is stored.
+type APIKey struct {
+	// ID is the hash of the key, it identifies the key in logs and the admin
+	// API.
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Languages restricts the languages the key can run, all languages are
+	// allowed if it is empty.
+	Languages []workertypes.WorkerLanguage `json:"languages,omitempty"`
+	Quota     *APIKeyQuota                 `json:"quota,omitempty"`
+}
+
+// APIKeyQuota overrides the default rate limit for a key.
+type APIKeyQuota struct {
+	RunsPerMinute *int `json:"runsPerMinute,omitempty"`
+	Burst         *int `json:"burst,omitempty"`
+	MaxConcurrent *int `json:"maxConcurrent,omitempty"`
+}
+
+func (q *APIKeyQuota) Validate() error {
+	if q == nil {
+		return nil
+	}
+	for _, value := range []*int{q.RunsPerMinute, q.Burst, q.MaxConcurrent} {
+		if value != nil && *value < 0 {
+			return errors.New("quota must not be negative")
+		}
+	}
+	// An empty bucket would reject every run instead of disabling the limit
+	if q.Burst != nil && *q.Burst < 1 && (q.RunsPerMinute == nil || *q.RunsPerMinute > 0) {
+		return errors.New("burst must be at least 1 unless runsPerMinute is 0")
+	}
+	return nil
+}
+
+// apply returns the default rate limit with the fields of the quota which are
+// set.
+func (q *APIKeyQuota) apply(limit RateLimit) RateLimit {
+	if q == nil {
+		return limit
+	}
+	if q.RunsPerMinute != nil {
+		limit.Rate = float64(*q.RunsPerMinute) / 60
+	}
+	if q.Burst != nil {
+		limit.Burst = float64(*q.Burst)
+	}
+	if q.MaxConcurrent != nil {
+		limit.MaxConcurrent = *q.MaxConcurrent
+	}
+	return limit
+}
+
+func (k *APIKey) AllowsLanguage(language workertypes.WorkerLanguage) bool {
+	return len(k.Languages) == 0 || slices.Contains(k.Languages, language)
+}
+
+func hashAPIKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateAPIKey() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf("could not generate api key: %w", err)
+	}
+	return API_KEY_TOKEN_PREFIX + hex.EncodeToString(token), nil
+}
+
+func (s *server) getAPIKeyByID(ctx context.Context, id string) (*APIKey, error) {
+	resp, err := s.etcdClient.Get(ctx, API_KEY_PREFIX+id)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch api key: %w", err)
+	}
+	if resp.Count == 0 {
+		return nil, errAPIKeyNotFound
+	}
+	var apiKey *APIKey
+	if err := json.Unmarshal(resp.Kvs[0].Value, &apiKey); err != nil {
+		return nil, fmt.Errorf("could not unmarshal api key: %w", err)
+	}
+	return apiKey, nil
+}
+
+// bearerToken returns the token of the Authorization header.
+func bearerToken(c echo.Context) string {
+	token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authenticate resolves the API key of the request, requests without one have
+// to pass the Turnstile challenge instead.
+func (s *server) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := bearerToken(c)
+		if token == "" {
+			return next(c)
+		}
+		if s.etcdClient == nil {
+			err := rejectRun("api_key", http.StatusUnauthorized, "API keys are not supported")
+			s.auditRun(c.Request().Context(), nil, s.clientID(c), nil, err)
+			return jsonError(c, err)
+		}
+		apiKey, err := s.getAPIKeyByID(c.Request().Context(), hashAPIKey(token))
+		if errors.Is(err, errAPIKeyNotFound) {
+			err := rejectRun("api_key", http.StatusUnauthorized, "invalid API key")
+			s.auditRun(c.Request().Context(), nil, s.clientID(c), nil, err)
+			return jsonError(c, err)
+		}
+		if err != nil {
+			s.auditRun(c.Request().Context(), nil, s.clientID(c), nil, err)
+			return err
+		}
+		c.Set(apiKeyContextKey, apiKey)
+		c.SetRequest(c.Request().WithContext(logging.WithFields(c.Request().Context(), log.Fields{
+			"api-key-id":   apiKey.ID[:12],
+			"api-key-name": apiKey.Name,
+		})))
+		return next(c)
+	}
+}
+
+// getAPIKey returns the API key which the request got authenticated with.
+func getAPIKey(c echo.Context) *APIKey {
+	apiKey, _ := c.Get(apiKeyContextKey).(*APIKey)
+	return apiKey
+}
+
+type apiKeyCreateRequest struct {
+	Name      string                       `json:"name"`
+	Languages []workertypes.WorkerLanguage `json:"languages"`
+	Quota     *APIKeyQuota                 `json:"quota"`
+}
+
+func (r *apiKeyCreateRequest) Validate() error {
+	if r.Name == "" || len(r.Name) > API_KEY_MAX_NAME_SIZE {
+		return fmt.Errorf("name has to be between 1 and %d characters long", API_KEY_MAX_NAME_SIZE)
+	}
+	for _, language := range r.Languages {
+		if !language.IsValid() {
+			return fmt.Errorf("could not recognize language: %s", language)
+		}
+	}
+	return r.Quota.Validate()
+}
+
+func (s *server) handleAPIKeyCreate(c echo.Context) error {
+	var req *apiKeyCreateRequest
+	if err := c.Bind(&req); err != nil || req == nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "could not decode request body",
+		})
+	}
+	if err := req.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": err.Error(),
+		})
+	}
+	token, err := generateAPIKey()
+	if err != nil {
+		return err
+	}
+	apiKey := &APIKey{
+		ID:        hashAPIKey(token),
+		Name:      req.Name,
+		CreatedAt: time.Now(),
+		Languages: req.Languages,
+		Quota:     req.Quota,
+	}
+	value, err := json.Marshal(apiKey)
+	if err != nil {
+		return fmt.Errorf("could not marshal api key: %w", err)
+	}
+	if _, err := s.etcdClient.Put(c.Request().Context(), API_KEY_PREFIX+apiKey.ID, string(value)); err != nil {
+		return fmt.Errorf("could not save api key: %w", err)
+	}
+	// The key is only returned once, afterwards only its hash is known
+	return c.JSON(http.StatusCreated, echo.Map{
+		"key":    token,
+		"apiKey": apiKey,
+	})
+}
+
+func (s *server) handleAPIKeyDelete(c echo.Context) error {
+	resp, err := s.etcdClient.Delete(c.Request().Context(), API_KEY_PREFIX+c.Param("id"))
+	if err != nil {
+		return fmt.Errorf("could not delete api key: %w", err)
+	}
+	if resp.Deleted == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "api key not found",
+		})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
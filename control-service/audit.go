@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	log "github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	DEFAULT_AUDIT_RETENTION_DAYS = 30
+	// AUDIT_MEMORY_MAX_RECORDS caps the records which the memory store keeps.
+	AUDIT_MEMORY_MAX_RECORDS  = 10000
+	DEFAULT_AUDIT_QUERY_LIMIT = 100
+	AUDIT_QUERY_MAX_LIMIT     = 1000
+)
+
+// AuditRecord describes a finished run. It doesn't contain the code or the
+// identity of the client, only their hashes.
+type AuditRecord struct {
+	ID         string                     `json:"id"`
+	Time       time.Time                  `json:"time"`
+	ClientHash string                     `json:"clientHash"`
+	Language   workertypes.WorkerLanguage `json:"language"`
+	CodeHash   string                     `json:"codeHash"`
+	Version    string                     `json:"version,omitempty"`
+	// Duration is the execution time in milliseconds.
+	Duration   int64  `json:"duration"`
+	Outcome    string `json:"outcome"`
+	ErrorClass string `json:"errorClass,omitempty"`
+	// ProjectFiles is the number of files which got passed with the run and
+	// Files the number of files which the run produced.
+	ProjectFiles int `json:"projectFiles"`
+	Files        int `json:"files"`
+}
+
+// AuditQuery filters the records, empty fields match all records.
+type AuditQuery struct {
+	From     time.Time
+	To       time.Time
+	Language workertypes.WorkerLanguage
+	Outcome  string
+	Limit    int
+}
+
+func (q AuditQuery) matches(record *AuditRecord) bool {
+	if record.Time.Before(q.From) || !record.Time.Before(q.To) {
+		return false
+	}
+	if q.Language != "" && record.Language != q.Language {
+		return false
+	}
+	if q.Outcome != "" && record.Outcome != q.Outcome {
+		return false
+	}
+	return true
+}
+
+// AuditStore persists the records of the runs.
+type AuditStore interface {
+	Append(ctx context.Context, record *AuditRecord) error
+	// Query returns the matching records, the newest first.
+	Query(ctx context.Context, query AuditQuery) ([]*AuditRecord, error)
+}
+
+// newAuditStore creates the audit store which is configured via the
+// AUDIT_STORE env var. etcd is used by default if it is configured, otherwise
+// the records are only kept in memory. With "none" no records get kept.
+func newAuditStore(etcdClient *clientv3.Client) (AuditStore, error) {
+	retention := time.Duration(DEFAULT_AUDIT_RETENTION_DAYS) * 24 * time.Hour
+	if retentionEnv := os.Getenv("AUDIT_RETENTION_DAYS"); retentionEnv != "" {
+		days, err := strconv.Atoi(retentionEnv)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("could not parse 'AUDIT_RETENTION_DAYS' env var: %s", retentionEnv)
+		}
+		retention = time.Duration(days) * 24 * time.Hour
+	}
+	kind := os.Getenv("AUDIT_STORE")
+	if kind == "" {
+		kind = "memory"
+		if etcdClient != nil {
+			kind = "etcd"
+		}
+	}
+	if kind != "none" && len(auditHashKey) == 0 {
+		log.Warn("'AUDIT_HASH_KEY' env var is empty, the client hashes are not keyed")
+	}
+	switch kind {
+	case "etcd":
+		if etcdClient == nil {
+			return nil, errors.New("etcd audit store requires 'ETCD_ENDPOINT' env var")
+		}
+		return &etcdAuditStore{client: etcdClient, retention: retention}, nil
+	case "memory":
+		return &memoryAuditStore{retention: retention}, nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown audit store: %s", kind)
+	}
+}
+
+type memoryAuditStore struct {
+	mu        sync.Mutex
+	records   []*AuditRecord
+	retention time.Duration
+}
+
+func (m *memoryAuditStore) Append(ctx context.Context, record *AuditRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expired := time.Now().Add(-m.retention)
+	for len(m.records) > 0 && (len(m.records) >= AUDIT_MEMORY_MAX_RECORDS || m.records[0].Time.Before(expired)) {
+		m.records = m.records[1:]
+	}
+	m.records = append(m.records, record)
+	return nil
+}
+
+func (m *memoryAuditStore) Query(ctx context.Context, query AuditQuery) ([]*AuditRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := []*AuditRecord{}
+	for i := len(m.records) - 1; i >= 0 && len(records) < query.Limit; i-- {
+		if query.matches(m.records[i]) {
+			records = append(records, m.records[i])
+		}
+	}
+	return records, nil
+}
+
+// auditHashKey keys the hashes of the client identities, so the IPs can't be
+// recovered by hashing all of them.
+var auditHashKey = []byte(os.Getenv("AUDIT_HASH_KEY"))
+
+func hashAuditClient(client string) string {
+	mac := hmac.New(sha256.New, auditHashKey)
+	mac.Write([]byte(client))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func hashAuditCode(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// errRunRejected is returned for runs which got rejected before they were
+// executed, class tells the audit log why.
+type errRunRejected struct {
+	*echo.HTTPError
+	class string
+}
+
+func (e *errRunRejected) Unwrap() error {
+	return e.HTTPError
+}
+
+func rejectRun(class string, code int, message string) error {
+	return &errRunRejected{
+		HTTPError: echo.NewHTTPError(code, message),
+		class:     class,
+	}
+}
+
+// runErrorClass tells why a run did not succeed, beyond its outcome.
+func runErrorClass(payload *workertypes.WorkerResponsePayload, err error) string {
+	var rejected *errRunRejected
+	var httpErr *echo.HTTPError
+	switch {
+	case errors.As(err, &rejected):
+		return rejected.class
+	case err != nil && errors.As(err, &httpErr):
+		return runOutcome(payload, err)
+	case err != nil:
+		return "internal"
+	case payload.Success:
+		return ""
+	case payload.TimedOut:
+		return "timeout"
+	case payload.Signal != "":
+		return "signal:" + payload.Signal
+	case payload.ExitCode > 0:
+		return "exit_code"
+	default:
+		// The files could not be written or the command not be started
+		return "setup"
+	}
+}
+
+// auditRun appends the record of a finished or rejected run to the audit
+// store. req is nil for runs which got rejected before their request got
+// decoded. It does not block the run, failing to record it only gets logged.
+func (s *server) auditRun(ctx context.Context, req *workertypes.WorkerRequestPayload, client string, payload *workertypes.WorkerResponsePayload, err error) {
+	if s.auditStore == nil {
+		return
+	}
+	record := &AuditRecord{
+		ID:         uuid.New().String(),
+		Time:       time.Now(),
+		ClientHash: hashAuditClient(client),
+		Outcome:    runOutcome(payload, err),
+		ErrorClass: runErrorClass(payload, err),
+	}
+	if req != nil {
+		record.Language = req.Language
+		record.CodeHash = hashAuditCode(req.Code)
+		record.ProjectFiles = len(req.Files)
+	}
+	if payload != nil {
+		record.Version = payload.Version
+		record.Duration = payload.Duration
+		record.Files = len(payload.Files)
+	}
+	logger := logging.FromContext(ctx)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.auditStore.Append(ctx, record); err != nil {
+			logger.Printf("could not append audit record: %v", err)
+		}
+	}()
+}
+
+var auditOutcomes = []string{"success", "failure", "timeout", "cancelled", "worker_timeout", "worker_died", "queue_full", "drained", "rejected", "error"}
+
+func parseAuditQuery(c echo.Context) (AuditQuery, error) {
+	query := AuditQuery{
+		To:       time.Now(),
+		Language: workertypes.WorkerLanguage(c.QueryParam("language")),
+		Outcome:  c.QueryParam("outcome"),
+		Limit:    DEFAULT_AUDIT_QUERY_LIMIT,
+	}
+	for name, value := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if param := c.QueryParam(name); param != "" {
+			t, err := time.Parse(time.RFC3339, param)
+			if err != nil {
+				return query, fmt.Errorf("could not parse '%s', expected RFC 3339", name)
+			}
+			*value = t
+		}
+	}
+	if query.Language != "" && !query.Language.IsValid() {
+		return query, errors.New("could not recognize language")
+	}
+	if query.Outcome != "" && !slices.Contains(auditOutcomes, query.Outcome) {
+		return query, fmt.Errorf("unknown outcome, expected one of: %s", strings.Join(auditOutcomes, ", "))
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		var err error
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit <= 0 || query.Limit > AUDIT_QUERY_MAX_LIMIT {
+			return query, fmt.Errorf("limit has to be between 1 and %d", AUDIT_QUERY_MAX_LIMIT)
+		}
+	}
+	return query, nil
+}
+
+func (s *server) handleAuditQuery(c echo.Context) error {
+	query, err := parseAuditQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": err.Error(),
+		})
+	}
+	records, err := s.auditStore.Query(c.Request().Context(), query)
+	if err != nil {
+		return fmt.Errorf("could not query audit records: %w", err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"records": records,
+	})
+}
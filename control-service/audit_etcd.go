@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	AUDIT_KEY_PREFIX = "audit/"
+	// AUDIT_LEASE_WINDOW is how long the records share a lease, so not every
+	// record needs its own one. They expire up to this much after the
+	// retention.
+	AUDIT_LEASE_WINDOW     = time.Hour
+	AUDIT_QUERY_BATCH_SIZE = 500
+)
+
+type etcdAuditStore struct {
+	client    *clientv3.Client
+	retention time.Duration
+
+	leaseMu        sync.Mutex
+	lease          clientv3.LeaseID
+	leaseWindowEnd time.Time
+}
+
+// auditKey orders the records by their time, so a time range maps to a key
+// range.
+func auditKey(t time.Time) string {
+	if t.Before(time.Unix(0, 0)) {
+		return AUDIT_KEY_PREFIX
+	}
+	return fmt.Sprintf("%s%019d", AUDIT_KEY_PREFIX, t.UnixNano())
+}
+
+func (e *etcdAuditStore) leaseID(ctx context.Context) (clientv3.LeaseID, error) {
+	e.leaseMu.Lock()
+	defer e.leaseMu.Unlock()
+	if e.lease != 0 && time.Now().Before(e.leaseWindowEnd) {
+		return e.lease, nil
+	}
+	lease, err := e.client.Grant(ctx, int64((e.retention + AUDIT_LEASE_WINDOW).Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("could not grant lease: %w", err)
+	}
+	e.lease = lease.ID
+	e.leaseWindowEnd = time.Now().Add(AUDIT_LEASE_WINDOW)
+	return e.lease, nil
+}
+
+func (e *etcdAuditStore) Append(ctx context.Context, record *AuditRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("could not marshal audit record: %w", err)
+	}
+	lease, err := e.leaseID(ctx)
+	if err != nil {
+		return err
+	}
+	key := auditKey(record.Time) + "/" + record.ID
+	if _, err := e.client.Put(ctx, key, string(value), clientv3.WithLease(lease)); err != nil {
+		return fmt.Errorf("could not save audit record: %w", err)
+	}
+	return nil
+}
+
+// Query walks backwards through the time range in batches until it found
+// enough matching records.
+func (e *etcdAuditStore) Query(ctx context.Context, query AuditQuery) ([]*AuditRecord, error) {
+	start, end := auditKey(query.From), auditKey(query.To)
+	records := []*AuditRecord{}
+	for len(records) < query.Limit {
+		resp, err := e.client.Get(ctx, start,
+			clientv3.WithRange(end),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend),
+			clientv3.WithLimit(AUDIT_QUERY_BATCH_SIZE),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch audit records: %w", err)
+		}
+		for _, kv := range resp.Kvs {
+			var record *AuditRecord
+			if err := json.Unmarshal(kv.Value, &record); err != nil {
+				return nil, fmt.Errorf("could not unmarshal audit record: %w", err)
+			}
+			if query.matches(record) {
+				records = append(records, record)
+				if len(records) == query.Limit {
+					break
+				}
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		end = string(resp.Kvs[len(resp.Kvs)-1].Key)
+	}
+	return records, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MAX_POOL_SIZE is the upper bound of warm workers per language.
+	MAX_POOL_SIZE      = 64
+	AUTOSCALE_INTERVAL = 10 * time.Second
+	// The warm pool grows if obtaining a worker took longer than this on
+	// average during the last interval.
+	AUTOSCALE_UP_WAIT = 1 * time.Second
+	// The warm pool shrinks if no worker got obtained for this long.
+	AUTOSCALE_DOWN_IDLE = 5 * time.Minute
+)
+
+// PoolSize is the range in which the autoscaler keeps the amount of warm
+// workers of a language.
+type PoolSize struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+func (p PoolSize) Validate() error {
+	if p.Min < 0 || p.Max < p.Min || p.Max > MAX_POOL_SIZE {
+		return fmt.Errorf("pool size must satisfy 0 <= min (%d) <= max (%d) <= %d", p.Min, p.Max, MAX_POOL_SIZE)
+	}
+	return nil
+}
+
+// poolSizeFromEnv reads the pool size of a language from the
+// WORKER_<LANGUAGE>_MIN_COUNT and WORKER_<LANGUAGE>_MAX_COUNT env vars. The
+// minimum defaults to workerCount and the maximum to the minimum, which
+// disables autoscaling.
+func poolSizeFromEnv(language workertypes.WorkerLanguage, workerCount int) (PoolSize, error) {
+	prefix := fmt.Sprintf("WORKER_%s_", strings.ToUpper(string(language)))
+	size := PoolSize{Min: workerCount}
+	if value := os.Getenv(prefix + "MIN_COUNT"); value != "" {
+		var err error
+		size.Min, err = strconv.Atoi(value)
+		if err != nil {
+			return PoolSize{}, fmt.Errorf("could not parse '%sMIN_COUNT' env var: %w", prefix, err)
+		}
+	}
+	size.Max = size.Min
+	if value := os.Getenv(prefix + "MAX_COUNT"); value != "" {
+		var err error
+		size.Max, err = strconv.Atoi(value)
+		if err != nil {
+			return PoolSize{}, fmt.Errorf("could not parse '%sMAX_COUNT' env var: %w", prefix, err)
+		}
+	}
+	return size, size.Validate()
+}
+
+// autoscalerStats are collected between two autoscaler runs.
+type autoscalerStats struct {
+	acquisitions    int
+	totalWait       time.Duration
+	lastAcquisition time.Time
+}
+
+func (a autoscalerStats) averageWait() time.Duration {
+	if a.acquisitions == 0 {
+		return 0
+	}
+	return a.totalWait / time.Duration(a.acquisitions)
+}
+
+// decideTarget returns the amount of warm workers which the pool should
+// have based on the stats of the last interval.
+func decideTarget(size PoolSize, target int, stats autoscalerStats, now time.Time) int {
+	switch {
+	case stats.averageWait() > AUTOSCALE_UP_WAIT:
+		target++
+	case stats.acquisitions == 0 && now.Sub(stats.lastAcquisition) > AUTOSCALE_DOWN_IDLE:
+		target--
+	}
+	return max(size.Min, min(size.Max, target))
+}
+
+func (w *Workers) recordAcquisition(wait time.Duration) {
+	workerAcquisitionDuration.WithLabelValues(string(w.language)).Observe(wait.Seconds())
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stats.acquisitions++
+	w.stats.totalWait += wait
+	w.stats.lastAcquisition = time.Now()
+}
+
+func (w *Workers) runAutoscaler() {
+	ticker := time.NewTicker(AUTOSCALE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.autoscale()
+		}
+	}
+}
+
+func (w *Workers) autoscale() {
+	w.mu.Lock()
+	previousTarget := w.target
+	w.target = decideTarget(w.size, w.target, w.stats, time.Now())
+	target := w.target
+	w.stats = autoscalerStats{lastAcquisition: w.stats.lastAcquisition}
+	w.mu.Unlock()
+
+	logger := log.WithField("language", w.language)
+	switch {
+	case target > previousTarget:
+		logger.Printf("Scaling warm pool up to %d workers", target)
+		if err := w.Replenish(); err != nil {
+			logger.Printf("could not scale up: %v", err)
+		}
+	case target < previousTarget:
+		logger.Printf("Scaling warm pool down to %d workers", target)
+		w.shrink()
+	}
+}
+
+// shrink removes idle workers until the pool matches its target.
+func (w *Workers) shrink() {
+	w.mu.Lock()
+	var surplus []*Worker
+	if len(w.idle) > w.target {
+		surplus = w.idle[w.target:]
+		w.idle = slices.Clone(w.idle[:w.target])
+	}
+	w.mu.Unlock()
+	for _, worker := range surplus {
+		if err := worker.Cleanup(); err != nil {
+			log.Printf("could not cleanup idle worker: %v", err)
+		}
+	}
+}
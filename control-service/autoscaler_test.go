@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDecideTarget(t *testing.T) {
+	now := time.Now()
+	size := PoolSize{Min: 1, Max: 4}
+	tests := []struct {
+		name   string
+		size   PoolSize
+		target int
+		stats  autoscalerStats
+		want   int
+	}{
+		{
+			name:   "grows on long waits",
+			size:   size,
+			target: 2,
+			stats:  autoscalerStats{acquisitions: 2, totalWait: 4 * time.Second, lastAcquisition: now},
+			want:   3,
+		},
+		{
+			name:   "keeps size on short waits",
+			size:   size,
+			target: 2,
+			stats:  autoscalerStats{acquisitions: 2, totalWait: time.Second, lastAcquisition: now},
+			want:   2,
+		},
+		{
+			name:   "shrinks after idle",
+			size:   size,
+			target: 2,
+			stats:  autoscalerStats{lastAcquisition: now.Add(-AUTOSCALE_DOWN_IDLE - time.Second)},
+			want:   1,
+		},
+		{
+			name:   "keeps size while recently used",
+			size:   size,
+			target: 2,
+			stats:  autoscalerStats{lastAcquisition: now.Add(-time.Minute)},
+			want:   2,
+		},
+		{
+			name:   "clamps to max",
+			size:   size,
+			target: 4,
+			stats:  autoscalerStats{acquisitions: 1, totalWait: 10 * time.Second, lastAcquisition: now},
+			want:   4,
+		},
+		{
+			name:   "clamps to min",
+			size:   size,
+			target: 1,
+			stats:  autoscalerStats{lastAcquisition: now.Add(-time.Hour)},
+			want:   1,
+		},
+		{
+			name:   "moves into a changed range",
+			size:   PoolSize{Min: 3, Max: 5},
+			target: 1,
+			stats:  autoscalerStats{lastAcquisition: now},
+			want:   3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := decideTarget(test.size, test.target, test.stats, now); got != test.want {
+				t.Errorf("expected target %d, got %d", test.want, got)
+			}
+		})
+	}
+}
+
+// newFakeKubernetesRuntime returns a runtime backed by a fake clientset which
+// names the pods like the API server does.
+func newFakeKubernetesRuntime(t *testing.T) (*kubernetesRuntime, *fake.Clientset) {
+	t.Helper()
+	clientSet := fake.NewClientset()
+	created := 0
+	clientSet.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*v1.Pod)
+		if pod.Name == "" {
+			created++
+			pod.Name = fmt.Sprintf("%s%d", pod.GenerateName, created)
+		}
+		return false, nil, nil
+	})
+	templates, err := loadPodTemplates("")
+	if err != nil {
+		t.Fatalf("could not load pod templates: %v", err)
+	}
+	return &kubernetesRuntime{
+		clientSet: clientSet,
+		owner:     "test",
+		templates: templates,
+	}, clientSet
+}
+
+func TestAutoscaleShrinksKubernetesPool(t *testing.T) {
+	k8sRuntime, clientSet := newFakeKubernetesRuntime(t)
+	language := workertypes.WorkerLanguagePython
+	workers := &Workers{
+		language: language,
+		runtime:  k8sRuntime,
+		size:     PoolSize{Min: 1, Max: 4},
+		target:   3,
+		stats:    autoscalerStats{lastAcquisition: time.Now().Add(-time.Hour)},
+		inFlight: map[string]*Worker{},
+	}
+	for i := 0; i < 3; i++ {
+		worker := &Worker{
+			id:        uuid.New().String(),
+			workers:   workers,
+			language:  language,
+			image:     "worker-python:test",
+			createdAt: time.Now(),
+		}
+		var err error
+		worker.handle, err = k8sRuntime.Start(context.Background(), worker)
+		if err != nil {
+			t.Fatalf("could not start worker: %v", err)
+		}
+		workers.idle = append(workers.idle, worker)
+	}
+	oldest := workers.idle[0].handle
+
+	expectPods := func(want int) {
+		t.Helper()
+		pods, err := clientSet.CoreV1().Pods(K8_NAMESPACE_NAME).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("could not list pods: %v", err)
+		}
+		if len(pods.Items) != want {
+			t.Fatalf("expected %d pods, got %d", want, len(pods.Items))
+		}
+		if workers.warmCount() != want {
+			t.Fatalf("expected %d warm workers, got %d", want, workers.warmCount())
+		}
+	}
+	expectPods(3)
+
+	// Each idle interval removes one worker until the minimum is reached
+	for _, want := range []int{2, 1, 1} {
+		workers.autoscale()
+		if workers.Target() != want {
+			t.Fatalf("expected target %d, got %d", want, workers.Target())
+		}
+		expectPods(want)
+	}
+	if workers.idle[0].handle != oldest {
+		t.Errorf("expected the oldest worker to be kept")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type workerHealth int
+
+const (
+	workerHealthStarting workerHealth = iota
+	workerHealthReady
+	workerHealthDead
+)
+
+// handleRuntimeEvent replaces idle workers as soon as their process dies, fails
+// the runs of handed out ones and hands workers which became ready to the
+// waiters.
+func (w *Workers) handleRuntimeEvent(handle string) {
+	value, ok := w.handles.Load(handle)
+	if !ok {
+		return
+	}
+	worker := value.(*Worker)
+	switch worker.health() {
+	case workerHealthDead:
+		if w.removeIdle(worker) {
+			log.WithField("worker-id", worker.id).Printf("Process %s of idle worker died", handle)
+			go w.replace(worker)
+		} else if w.isInFlight(worker) {
+			// The run releases the worker once it noticed
+			log.WithField("worker-id", worker.id).Printf("Process %s of worker died during its run", handle)
+			worker.diedOnce.Do(func() {
+				close(worker.died)
+			})
+		}
+	case workerHealthReady:
+		w.dispatch()
+	}
+}
+
+func (w *Worker) health() workerHealth {
+	return w.workers.runtime.Health(w)
+}
+
+// consumerHealth checks whether the worker process is consuming its queue. A
+// separate channel is used since a failing passive declare closes it.
+func (w *Worker) consumerHealth() workerHealth {
+	channel, err := w.workers.amqpConnection.Channel()
+	if err != nil {
+		log.Printf("could not open channel: %v", err)
+		return workerHealthStarting
+	}
+	defer channel.Close()
+	queue, err := channel.QueueDeclarePassive(
+		fmt.Sprintf("rpc_queue_%s", w.id), // name
+		false,                             // durable
+		true,                              // delete when unused
+		false,                             // exclusive
+		false,                             // noWait
+		nil,                               // arguments
+	)
+	if err != nil {
+		// The queue got deleted since its consumer went away
+		return workerHealthDead
+	}
+	if queue.Consumers == 0 {
+		return workerHealthStarting
+	}
+	return workerHealthReady
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+)
+
+// fakeRuntime reports the same health for all workers.
+type fakeRuntime struct {
+	health workerHealth
+}
+
+func (f *fakeRuntime) Start(ctx context.Context, worker *Worker) (string, error) {
+	return worker.id, nil
+}
+
+func (f *fakeRuntime) Stop(ctx context.Context, worker *Worker) error {
+	return nil
+}
+
+func (f *fakeRuntime) Health(worker *Worker) workerHealth {
+	return f.health
+}
+
+func (f *fakeRuntime) Watch(language workertypes.WorkerLanguage, stop <-chan struct{}, onChange func(handle string)) error {
+	return nil
+}
+
+func TestHandleRuntimeEventFailsRunOfDeadWorker(t *testing.T) {
+	runtime := &fakeRuntime{health: workerHealthReady}
+	workers := newTestWorkers(workertypes.WorkerLanguagePython)
+	workers.runtime = runtime
+	workers.inFlight = map[string]*Worker{}
+	worker := &Worker{
+		id:        uuid.New().String(),
+		workers:   workers,
+		handle:    "worker-python-1",
+		language:  workertypes.WorkerLanguagePython,
+		createdAt: time.Now(),
+	}
+	workers.register(worker)
+	workers.markInFlight(context.Background(), worker, "ip:203.0.113.1")
+
+	workers.handleRuntimeEvent(worker.handle)
+	select {
+	case <-worker.Died():
+		t.Fatalf("expected a ready worker to keep running")
+	default:
+	}
+
+	runtime.health = workerHealthDead
+	// Repeated events of the same pod must not close the channel twice
+	for i := 0; i < 2; i++ {
+		workers.handleRuntimeEvent(worker.handle)
+	}
+	select {
+	case <-worker.Died():
+	case <-time.After(time.Second):
+		t.Fatalf("expected the run to notice that the worker died")
+	}
+}
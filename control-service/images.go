@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	log "github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	WORKER_IMAGE_KEY_PREFIX = "workerimages/"
+	WORKER_IMAGE_REPOSITORY = "ghcr.io/mxschmitt/try-playwright/worker-%s"
+)
+
+// imageTagRegexp matches the tags which Docker accepts.
+var imageTagRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// workerImages resolves the images of the workers. The tag of each language
+// can be changed at runtime via etcd, WORKER_IMAGE_TAG is used otherwise.
+type workerImages struct {
+	defaultTag string
+
+	mu sync.RWMutex
+	// tags are the tags which got rolled out and wanted the ones from etcd.
+	// They differ until a canary worker with the wanted tag became ready.
+	tags   map[workertypes.WorkerLanguage]string
+	wanted map[workertypes.WorkerLanguage]string
+}
+
+func newWorkerImages() *workerImages {
+	return &workerImages{
+		defaultTag: os.Getenv("WORKER_IMAGE_TAG"),
+		tags:       map[workertypes.WorkerLanguage]string{},
+		wanted:     map[workertypes.WorkerLanguage]string{},
+	}
+}
+
+func workerImageName(language workertypes.WorkerLanguage, tag string) string {
+	return fmt.Sprintf(WORKER_IMAGE_REPOSITORY+":%s", language, tag)
+}
+
+func (i *workerImages) lookup(tags map[workertypes.WorkerLanguage]string, language workertypes.WorkerLanguage) string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if tag, ok := tags[language]; ok {
+		return tag
+	}
+	return i.defaultTag
+}
+
+// Tag returns the tag which new workers of the language use.
+func (i *workerImages) Tag(language workertypes.WorkerLanguage) string {
+	return i.lookup(i.tags, language)
+}
+
+func (i *workerImages) Image(language workertypes.WorkerLanguage) string {
+	return workerImageName(language, i.Tag(language))
+}
+
+// WantedTag returns the tag from etcd, which might not be rolled out yet.
+func (i *workerImages) WantedTag(language workertypes.WorkerLanguage) string {
+	return i.lookup(i.wanted, language)
+}
+
+func setTag(tags map[workertypes.WorkerLanguage]string, language workertypes.WorkerLanguage, tag string) {
+	if tag == "" {
+		delete(tags, language)
+	} else {
+		tags[language] = tag
+	}
+}
+
+// set rolls out the tag of the language, an empty tag resets it to the
+// default.
+func (i *workerImages) set(language workertypes.WorkerLanguage, tag string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	setTag(i.tags, language, tag)
+}
+
+// want records the tag from etcd, it gets rolled out by rolloutImage.
+func (i *workerImages) want(language workertypes.WorkerLanguage, tag string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	setTag(i.wanted, language, tag)
+}
+
+func workerImageKey(language workertypes.WorkerLanguage) string {
+	return WORKER_IMAGE_KEY_PREFIX + string(language)
+}
+
+// load reads the wanted tags from etcd and returns the revision from which on
+// the changes need to be watched.
+func (i *workerImages) load(ctx context.Context, etcdClient *clientv3.Client) (int64, error) {
+	resp, err := etcdClient.Get(ctx, WORKER_IMAGE_KEY_PREFIX, clientv3.WithPrefix())
+	if err != nil {
+		return 0, fmt.Errorf("could not fetch worker image tags: %w", err)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.wanted = map[workertypes.WorkerLanguage]string{}
+	for _, kv := range resp.Kvs {
+		language := workertypes.WorkerLanguage(strings.TrimPrefix(string(kv.Key), WORKER_IMAGE_KEY_PREFIX))
+		i.wanted[language] = string(kv.Value)
+	}
+	return resp.Header.Revision, nil
+}
+
+// applyWanted uses the wanted tags right away. This is only done on startup,
+// since the other replicas rolled them out already.
+func (i *workerImages) applyWanted() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.tags = maps.Clone(i.wanted)
+}
+
+// watchWorkerImages rolls out the images whose tag got changed in etcd,
+// starting after revision. The tags get reloaded if the watch fails, e.g.
+// because the revision got compacted.
+func (s *server) watchWorkerImages(ctx context.Context, revision int64) {
+	for {
+		for resp := range s.etcdClient.Watch(ctx, WORKER_IMAGE_KEY_PREFIX, clientv3.WithPrefix(), clientv3.WithRev(revision+1)) {
+			if err := resp.Err(); err != nil {
+				log.Printf("could not watch worker image tags: %v", err)
+				break
+			}
+			for _, event := range resp.Events {
+				language := workertypes.WorkerLanguage(strings.TrimPrefix(string(event.Kv.Key), WORKER_IMAGE_KEY_PREFIX))
+				tag := ""
+				if event.Type == clientv3.EventTypePut {
+					tag = string(event.Kv.Value)
+				}
+				s.images.want(language, tag)
+				s.rolloutImage(language)
+			}
+			revision = resp.Header.Revision
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		var err error
+		revision, err = s.images.load(ctx, s.etcdClient)
+		if err != nil {
+			log.Printf("could not reload worker image tags: %v", err)
+			continue
+		}
+		for language := range s.workers {
+			s.rolloutImage(language)
+		}
+	}
+}
+
+// rolloutImage rolls out the wanted tag of the language in the background,
+// if it isn't already.
+func (s *server) rolloutImage(language workertypes.WorkerLanguage) {
+	workers, ok := s.workers[language]
+	if !ok || workerImageName(language, s.images.WantedTag(language)) == s.images.Image(language) {
+		return
+	}
+	go workers.rolloutImage()
+}
+
+// rolloutImage rolls out the wanted tag. A canary worker with the new image
+// has to become ready first, otherwise the current tag is kept. Each rollout
+// picks up the latest wanted tag, so the ones which queued up meanwhile have
+// nothing left to do.
+func (w *Workers) rolloutImage() {
+	w.replaceMu.Lock()
+	defer w.replaceMu.Unlock()
+	tag := w.images.WantedTag(w.language)
+	image := workerImageName(w.language, tag)
+	if image == w.images.Image(w.language) {
+		return
+	}
+	logger := log.WithFields(log.Fields{"language": w.language, "image": image})
+	if w.isDraining() {
+		// There are no workers to replace, the tag gets used once it resumes
+		w.images.set(w.language, tag)
+		return
+	}
+	logger.Println("Starting canary worker")
+	if !w.surge(image) {
+		logger.Error("Canary worker did not become ready, keeping the current image")
+		return
+	}
+	w.images.set(w.language, tag)
+	logger.Println("Rolling out image")
+	outdated := func(worker *Worker) bool {
+		return worker.image != image
+	}
+	// The canary takes the place of the oldest outdated worker
+	if old := w.findIdle(outdated); old != nil {
+		w.retire(old)
+	}
+	w.replaceIdle(outdated)
+}
+
+type imageTagRequest struct {
+	Tag string `json:"tag"`
+}
+
+func (s *server) handleImageList(c echo.Context) error {
+	languages := map[workertypes.WorkerLanguage]echo.Map{}
+	for language := range s.workers {
+		languages[language] = echo.Map{
+			"tag":       s.images.Tag(language),
+			"image":     s.images.Image(language),
+			"wantedTag": s.images.WantedTag(language),
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"languages": languages,
+	})
+}
+
+// handleImageUpdate stores the tag in etcd, all replicas roll it out once
+// they see the change.
+func (s *server) handleImageUpdate(c echo.Context) error {
+	workers, err := s.pool(c)
+	if err != nil {
+		return jsonError(c, err)
+	}
+	var req *imageTagRequest
+	if err := c.Bind(&req); err != nil || req == nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "could not decode request body",
+		})
+	}
+	if !imageTagRegexp.MatchString(req.Tag) {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "invalid image tag",
+		})
+	}
+	if _, err := s.etcdClient.Put(c.Request().Context(), workerImageKey(workers.language), req.Tag); err != nil {
+		return fmt.Errorf("could not save worker image tag: %w", err)
+	}
+	return c.JSON(http.StatusAccepted, echo.Map{
+		"tag":   req.Tag,
+		"image": workerImageName(workers.language, req.Tag),
+	})
+}
+
+// handleImageReset rolls the language back to WORKER_IMAGE_TAG.
+func (s *server) handleImageReset(c echo.Context) error {
+	workers, err := s.pool(c)
+	if err != nil {
+		return jsonError(c, err)
+	}
+	if _, err := s.etcdClient.Delete(c.Request().Context(), workerImageKey(workers.language)); err != nil {
+		return fmt.Errorf("could not delete worker image tag: %w", err)
+	}
+	return c.NoContent(http.StatusAccepted)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	log "github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	JOB_KEY_PREFIX        = "jobs/"
+	DEFAULT_JOB_RETENTION = 60 * 60
+	// JOB_CANCEL_WAIT is how long a cancellation waits for the job to finish
+	// before it gets answered with JobStatusCancelling.
+	JOB_CANCEL_WAIT = 5 * time.Second
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued    JobStatus = "queued"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+	JobStatusTimedOut  JobStatus = "timed_out"
+	JobStatusCancelled JobStatus = "cancelled"
+	// JobStatusCancelling only gets reported to the client which requested
+	// the cancellation, the stored job keeps its status until it finished.
+	JobStatusCancelling JobStatus = "cancelling"
+)
+
+func (status JobStatus) IsFinished() bool {
+	return status != JobStatusQueued && status != JobStatusRunning && status != JobStatusCancelling
+}
+
+type Job struct {
+	ID            string                             `json:"id"`
+	Status        JobStatus                          `json:"status"`
+	Language      workertypes.WorkerLanguage         `json:"language"`
+	CreatedAt     time.Time                          `json:"createdAt"`
+	UpdatedAt     time.Time                          `json:"updatedAt"`
+	QueuePosition int                                `json:"queuePosition,omitempty"`
+	Error         string                             `json:"error,omitempty"`
+	Result        *workertypes.WorkerResponsePayload `json:"result,omitempty"`
+
+	// lease is shared by all keys of the job, it gets granted on creation
+	lease clientv3.LeaseID
+}
+
+func jobKey(id string) string {
+	return JOB_KEY_PREFIX + id
+}
+
+func jobCancelKey(id string) string {
+	return jobKey(id) + "/cancel"
+}
+
+// putJob persists the job. The first write grants the lease of the job, later
+// writes reuse it. Its retention starts again once the job finished. It
+// returns the etcd revision of the write.
+func (s *server) putJob(ctx context.Context, job *Job) (int64, error) {
+	job.UpdatedAt = time.Now()
+	body, err := json.Marshal(job)
+	if err != nil {
+		return 0, fmt.Errorf("could not marshal job: %w", err)
+	}
+	if job.lease == 0 {
+		lease, err := s.etcdClient.Grant(ctx, int64(s.jobRetention.Seconds()))
+		if err != nil {
+			return 0, fmt.Errorf("could not grant lease: %w", err)
+		}
+		job.lease = lease.ID
+	} else if job.Status.IsFinished() {
+		if _, err := s.etcdClient.KeepAliveOnce(ctx, job.lease); err != nil {
+			return 0, fmt.Errorf("could not renew lease: %w", err)
+		}
+	}
+	resp, err := s.etcdClient.Put(ctx, jobKey(job.ID), string(body), clientv3.WithLease(job.lease))
+	if err != nil {
+		return 0, fmt.Errorf("could not save job: %w", err)
+	}
+	return resp.Header.Revision, nil
+}
+
+// getJob returns the job and the etcd revision at which it got read.
+func (s *server) getJob(ctx context.Context, id string) (*Job, int64, error) {
+	resp, err := s.etcdClient.Get(ctx, jobKey(id))
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not fetch job: %w", err)
+	}
+	if resp.Count == 0 {
+		return nil, resp.Header.Revision, nil
+	}
+	job, err := unmarshalJob(resp.Kvs[0].Value, resp.Kvs[0].Lease)
+	if err != nil {
+		return nil, 0, err
+	}
+	return job, resp.Header.Revision, nil
+}
+
+func unmarshalJob(value []byte, lease int64) (*Job, error) {
+	var job *Job
+	if err := json.Unmarshal(value, &job); err != nil {
+		return nil, fmt.Errorf("could not unmarshal job: %w", err)
+	}
+	job.lease = clientv3.LeaseID(lease)
+	return job, nil
+}
+
+// waitForJob waits until the job finished, starting after the given
+// revision. It returns nil once ctx is done first.
+func (s *server) waitForJob(ctx context.Context, id string, revision int64) (*Job, error) {
+	for resp := range s.etcdClient.Watch(ctx, jobKey(id), clientv3.WithRev(revision+1)) {
+		if err := resp.Err(); err != nil {
+			return nil, fmt.Errorf("could not watch job: %w", err)
+		}
+		for _, event := range resp.Events {
+			if event.Type != clientv3.EventTypePut {
+				continue
+			}
+			job, err := unmarshalJob(event.Kv.Value, event.Kv.Lease)
+			if err != nil {
+				return nil, err
+			}
+			if job.Status.IsFinished() {
+				return job, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (s *server) updateJob(job *Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.putJob(ctx, job); err != nil {
+		log.WithField("job-id", job.ID).Printf("could not update job: %v", err)
+	}
+}
+
+func (s *server) handleJobCreate(c echo.Context) error {
+	req, err := s.parseRunRequest(c)
+	if err != nil {
+		s.auditRun(c.Request().Context(), req, s.clientID(c), nil, err)
+		return jsonError(c, err)
+	}
+	job := &Job{
+		ID:        uuid.New().String(),
+		Status:    JobStatusQueued,
+		Language:  req.Language,
+		CreatedAt: time.Now(),
+	}
+	revision, err := s.putJob(c.Request().Context(), job)
+	if err != nil {
+		err = fmt.Errorf("could not create job: %w", err)
+		s.auditRun(c.Request().Context(), req, s.clientID(c), nil, err)
+		return err
+	}
+	// The run counts against the concurrency limit until the job finished
+	release := takeRateLimitRelease(c)
+	client := s.clientID(c)
+	// The job outlives the request, so only its trace and logger get continued
+	ctx := logging.Detach(c.Request().Context())
+	ctx = trace.ContextWithSpanContext(ctx, trace.SpanContextFromContext(c.Request().Context()))
+	ctx = logging.WithFields(ctx, log.Fields{"job-id": job.ID})
+	go func() {
+		defer release()
+		s.runJob(ctx, job, req, client, revision)
+	}()
+
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/service/control/jobs/%s", job.ID))
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// runJob executes the job until it finishes or gets cancelled. Cancellations
+// are requested via etcd, so they reach the job independent of which replica
+// is running it. createdRevision is the revision at which the job got created.
+func (s *server) runJob(ctx context.Context, job *Job, req *workertypes.WorkerRequestPayload, client string, createdRevision int64) {
+	logger := logging.FromContext(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		for resp := range s.etcdClient.Watch(ctx, jobCancelKey(job.ID), clientv3.WithRev(createdRevision+1)) {
+			if len(resp.Events) > 0 {
+				logger.Println("Received job cancellation")
+				cancel()
+				return
+			}
+		}
+	}()
+
+	payload, err := s.executeRun(ctx, req, runOptions{
+		client: client,
+		onQueued: func(position int) {
+			job.QueuePosition = position
+			s.updateJob(job)
+		},
+		onStart: func() {
+			job.Status = JobStatusRunning
+			job.QueuePosition = 0
+			s.updateJob(job)
+		},
+	})
+	switch {
+	case err != nil:
+		job.Status = JobStatusFailed
+		if errors.Is(err, errExecutionTimeout) {
+			job.Status = JobStatusTimedOut
+		} else if errors.Is(err, errRunCancelled) {
+			job.Status = JobStatusCancelled
+		}
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			job.Error = fmt.Sprint(httpErr.Message)
+		} else {
+			logger.Printf("could not execute job: %v", err)
+			job.Error = "Execution was not successful!"
+		}
+	case payload.TimedOut:
+		job.Status = JobStatusTimedOut
+		job.Error = payload.Error
+	case !payload.Success:
+		job.Status = JobStatusFailed
+		job.Error = payload.Error
+	default:
+		job.Status = JobStatusSucceeded
+	}
+	job.Result = payload
+	s.updateJob(job)
+}
+
+// handleJobCancel requests the cancellation and waits briefly for the job to
+// be torn down. Jobs which take longer get reported as JobStatusCancelling,
+// their final status is available via handleJobGet.
+func (s *server) handleJobCancel(c echo.Context) error {
+	ctx := c.Request().Context()
+	job, revision, err := s.getJob(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "job not found",
+		})
+	}
+	if job.Status.IsFinished() {
+		return c.JSON(http.StatusConflict, echo.Map{
+			"error": fmt.Sprintf("job already finished with status %s", job.Status),
+		})
+	}
+	if _, err := s.etcdClient.Put(ctx, jobCancelKey(job.ID), "", clientv3.WithLease(job.lease)); err != nil {
+		return fmt.Errorf("could not request job cancellation: %w", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, JOB_CANCEL_WAIT)
+	defer cancel()
+	finished, err := s.waitForJob(waitCtx, job.ID, revision)
+	if err != nil {
+		return err
+	}
+	if finished != nil {
+		return c.JSON(http.StatusOK, finished)
+	}
+	return c.JSON(http.StatusAccepted, echo.Map{
+		"id":     job.ID,
+		"status": JobStatusCancelling,
+	})
+}
+
+func (s *server) handleJobGet(c echo.Context) error {
+	resp, err := s.etcdClient.Get(c.Request().Context(), jobKey(c.Param("id")))
+	if err != nil {
+		return fmt.Errorf("could not fetch job: %w", err)
+	}
+	if resp.Count == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "job not found",
+		})
+	}
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, resp.Kvs[0].Value)
+}
@@ -5,7 +5,6 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
-	"io"
 	"math/big"
 	"net/http"
 	"os"
@@ -16,40 +15,62 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/mxschmitt/try-playwright/internal/echoutils"
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	"github.com/mxschmitt/try-playwright/internal/tracing"
 	"github.com/mxschmitt/try-playwright/internal/workertypes"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/getsentry/sentry-go"
 	sentryecho "github.com/getsentry/sentry-go/echo"
 
+	"github.com/prometheus/client_golang/prometheus"
 	amqp "github.com/rabbitmq/amqp091-go"
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	SNIPPET_ID_LENGTH = 7
 	K8_NAMESPACE_NAME = "default"
-	WORKER_TIMEOUT    = 10
+	// QUEUE_TIMEOUT is how long a run waits in the queue for a worker.
+	QUEUE_TIMEOUT     = 60
 	EXECUTION_TIMEOUT = 60
+	// The worker enforces a slightly shorter timeout, so it can still reply
+	// with the partial output before the control-service gives up on it.
+	WORKER_EXECUTION_TIMEOUT_MARGIN = 5
 )
 
-func init() {
-	log.SetFormatter(&log.TextFormatter{
-		TimestampFormat: time.StampMilli,
-	})
-}
-
 type server struct {
 	server *echo.Echo
 
 	etcdClient *clientv3.Client
+	shareStore ShareStore
+	// auditStore is nil if the runs should not be recorded.
+	auditStore AuditStore
+
+	captchaVerifier CaptchaVerifier
+	rateLimit       RateLimit
+	rateLimitStore  RateLimitStore
 
 	amqpConnection *amqp.Connection
 	amqpErrorChan  chan *amqp.Error
 
+	runtime WorkerRuntime
+	images  *workerImages
+	// stopImageWatch stops watching the image tags in etcd.
+	stopImageWatch context.CancelFunc
+	// kubernetes is set if the workers run on Kubernetes, only then their
+	// pods get reconciled.
+	kubernetes     *kubernetesRuntime
+	instanceID     string
+	stopReconciler chan struct{}
+
 	workers map[workertypes.WorkerLanguage]*Workers
+
+	jobRetention time.Duration
+
+	shutdownTracing func(context.Context) error
 }
 
 func newServer() (*server, error) {
@@ -60,21 +81,46 @@ func newServer() (*server, error) {
 		return nil, fmt.Errorf("could not init Sentry: %w", err)
 	}
 
-	etcdClient, err := clientv3.New(clientv3.Config{
-		Endpoints:   []string{os.Getenv("ETCD_ENDPOINT")},
-		DialTimeout: 5 * time.Second,
-	})
+	shutdownTracing, err := tracing.Setup(context.Background(), "control-service")
+	if err != nil {
+		return nil, fmt.Errorf("could not setup tracing: %w", err)
+	}
+
+	// etcd is optional for self-hosters which use a different share store,
+	// the features which rely on it get disabled without it.
+	var etcdClient *clientv3.Client
+	if etcdEndpoint := os.Getenv("ETCD_ENDPOINT"); etcdEndpoint != "" {
+		etcdClient, err = clientv3.New(clientv3.Config{
+			Endpoints:   []string{etcdEndpoint},
+			DialTimeout: 5 * time.Second,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to etcd: %w", err)
+		}
+	}
+
+	shareStore, err := newShareStore(etcdClient)
+	if err != nil {
+		return nil, fmt.Errorf("could not create share store: %w", err)
+	}
+
+	captchaVerifier, err := newCaptchaVerifier()
 	if err != nil {
-		return nil, fmt.Errorf("could not connect to etcd: %w", err)
+		return nil, fmt.Errorf("could not create captcha verifier: %w", err)
 	}
 
-	config, err := rest.InClusterConfig()
+	rateLimit, err := rateLimitFromEnv()
 	if err != nil {
-		return nil, fmt.Errorf("could not create k8 in cluster config: %w", err)
+		return nil, fmt.Errorf("invalid rate limit: %w", err)
 	}
-	k8ClientSet, err := kubernetes.NewForConfig(config)
+	rateLimitStore, err := newRateLimitStore(etcdClient)
 	if err != nil {
-		return nil, fmt.Errorf("could not create k8 clientset: %w", err)
+		return nil, fmt.Errorf("could not create rate limit store: %w", err)
+	}
+
+	auditStore, err := newAuditStore(etcdClient)
+	if err != nil {
+		return nil, fmt.Errorf("could not create audit store: %w", err)
 	}
 
 	amqpConnection, err := amqp.Dial(os.Getenv("AMQP_URL"))
@@ -97,19 +143,94 @@ func newServer() (*server, error) {
 		}
 	}
 
+	maxQueueLength := DEFAULT_MAX_QUEUE_LENGTH
+	if maxQueueLengthEnv := os.Getenv("MAX_QUEUE_LENGTH"); maxQueueLengthEnv != "" {
+		maxQueueLength, err = strconv.Atoi(maxQueueLengthEnv)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse max queue length from 'MAX_QUEUE_LENGTH' env var: %w", err)
+		}
+	}
+
+	jobRetention := DEFAULT_JOB_RETENTION
+	if jobRetentionEnv := os.Getenv("JOB_RETENTION"); jobRetentionEnv != "" {
+		jobRetention, err = strconv.Atoi(jobRetentionEnv)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse job retention from 'JOB_RETENTION' env var: %w", err)
+		}
+	}
+
+	instanceID, err := determineInstanceID()
+	if err != nil {
+		return nil, err
+	}
+
+	runtime, err := newWorkerRuntime(instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("could not create worker runtime: %w", err)
+	}
+	kubernetes, _ := runtime.(*kubernetesRuntime)
+
+	images := newWorkerImages()
+	var imagesRevision int64
+	if etcdClient != nil {
+		imagesRevision, err = images.load(context.Background(), etcdClient)
+		if err != nil {
+			return nil, err
+		}
+		images.applyWanted()
+	}
+
 	workersMap := map[workertypes.WorkerLanguage]*Workers{}
 	for _, lang := range workertypes.SUPPORTED_LANGUAGES {
-		workersMap[lang], err = newWorkers(lang, workerCount, k8ClientSet, amqpChannel)
+		poolSize, err := poolSizeFromEnv(lang, workerCount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pool size: %w", lang, err)
+		}
+		workersMap[lang], err = newWorkers(lang, poolSize, maxQueueLength, runtime, images, amqpConnection, amqpChannel)
 		if err != nil {
 			return nil, fmt.Errorf("could not create new %s workers: %w", lang, err)
 		}
 	}
 
 	s := &server{
-		etcdClient:     etcdClient,
-		amqpConnection: amqpConnection,
-		amqpErrorChan:  amqpErrorChan,
-		workers:        workersMap,
+		etcdClient:      etcdClient,
+		shareStore:      shareStore,
+		auditStore:      auditStore,
+		captchaVerifier: captchaVerifier,
+		rateLimit:       rateLimit,
+		rateLimitStore:  rateLimitStore,
+		amqpConnection:  amqpConnection,
+		amqpErrorChan:   amqpErrorChan,
+		workers:         workersMap,
+		runtime:         runtime,
+		images:          images,
+		kubernetes:      kubernetes,
+		instanceID:      instanceID,
+		stopReconciler:  make(chan struct{}),
+		jobRetention:    time.Duration(jobRetention) * time.Second,
+		shutdownTracing: shutdownTracing,
+	}
+
+	// Adopt the warm workers of crashed instances before creating new ones
+	if kubernetes != nil {
+		if err := s.labelControlPod(context.Background()); err != nil {
+			return nil, err
+		}
+		if err := s.reconcileWorkers(context.Background()); err != nil {
+			return nil, fmt.Errorf("could not reconcile workers: %w", err)
+		}
+		go s.runReconciler()
+	}
+	if etcdClient != nil {
+		var watchCtx context.Context
+		watchCtx, s.stopImageWatch = context.WithCancel(context.Background())
+		go s.watchWorkerImages(watchCtx, imagesRevision)
+	}
+	prometheus.MustRegister(newPoolCollector(workersMap))
+	for lang, workers := range workersMap {
+		if err := workers.Replenish(); err != nil {
+			return nil, fmt.Errorf("could not add initial %s workers: %w", lang, err)
+		}
 	}
 
 	s.initializeHttpServer()
@@ -120,11 +241,32 @@ func (s *server) initializeHttpServer() {
 	s.server = echo.New()
 	s.server.HTTPErrorHandler = echoutils.HTTPErrorHandler(s.server)
 	s.server.Use(sentryecho.New(sentryecho.Options{}))
+	s.server.Use(echoutils.Tracing())
+	s.server.Use(echoutils.RequestLogger(getTurnstileIP))
 	s.server.GET("/service/control/health", s.handleHealth)
 	s.server.HEAD("/service/control/health", s.handleHealth)
-	s.server.POST("/service/control/run", s.handleRun)
-	s.server.GET("/service/control/share/get/:id", s.handleShareGet)
-	s.server.POST("/service/control/share/create", s.handleShareCreate)
+	s.server.GET("/service/control/status", s.handleStatus)
+	// Not proxied by the frontend, so it is only reachable inside the cluster
+	s.server.GET("/metrics", metricsHandler())
+	s.server.POST("/service/control/run", s.handleRun, s.authenticate, s.rateLimitRuns)
+	s.server.POST("/service/control/run/stream", s.handleRunStream, s.authenticate, s.rateLimitRuns)
+	if s.etcdClient != nil {
+		s.server.POST("/service/control/jobs", s.handleJobCreate, s.authenticate, s.rateLimitRuns)
+		s.server.GET("/service/control/jobs/:id", s.handleJobGet)
+		s.server.POST("/service/control/jobs/:id/cancel", s.handleJobCancel)
+	}
+	s.server.GET("/service/control/share/get/:id", s.handleShareGet, countShares("get"))
+	s.server.POST("/service/control/share/create", s.handleShareCreate, countShares("create"))
+	s.server.DELETE("/service/control/share/:id", s.handleShareDelete, countShares("delete"))
+	s.initializeAdminRoutes()
+}
+
+// clientID identifies the caller by its API key or its IP.
+func (s *server) clientID(c echo.Context) string {
+	if apiKey := getAPIKey(c); apiKey != nil {
+		return "key:" + apiKey.ID
+	}
+	return "ip:" + getTurnstileIP(c)
 }
 
 func getTurnstileIP(c echo.Context) string {
@@ -135,80 +277,79 @@ func getTurnstileIP(c echo.Context) string {
 	return c.RealIP()
 }
 
-func (s *server) handleRun(c echo.Context) error {
-	var req *workertypes.WorkerRequestPayload
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "could not decode request body",
-		})
-	}
-	if !req.Language.IsValid() {
-		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "could not recognize language",
+// StatusClientClosedRequest is the non-standard status code (nginx) for
+// requests which got aborted by the client.
+const StatusClientClosedRequest = 499
+
+var (
+	errWorkerTimeout    = echo.NewHTTPError(http.StatusServiceUnavailable, "Timeout in getting a worker!")
+	errQueueFull        = echo.NewHTTPError(http.StatusServiceUnavailable, "Too many runs are waiting for a worker, try again later!")
+	errPoolDrained      = echo.NewHTTPError(http.StatusServiceUnavailable, "This language is currently unavailable, try again later!")
+	errExecutionTimeout = echo.NewHTTPError(http.StatusServiceUnavailable, "Execution timeout!")
+	errRunCancelled     = echo.NewHTTPError(StatusClientClosedRequest, "Execution got cancelled!")
+	errWorkerDied       = echo.NewHTTPError(http.StatusServiceUnavailable, "Worker died during the execution, try again!")
+)
+
+// jsonError writes HTTP errors in the format which the frontend expects and
+// hands all other errors over to the echo error handler.
+func jsonError(c echo.Context, err error) error {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return c.JSON(httpErr.Code, echo.Map{
+			"error": httpErr.Message,
 		})
 	}
+	return err
+}
 
-	log.Printf("Validating turnstile")
-	if err := ValidateTurnstile(c.Request().Context(), req.Token, getTurnstileIP(c), os.Getenv("TURNSTILE_SECRET_KEY")); err != nil {
-		log.Printf("Could not validate turnstile: %v", err)
-		return c.JSON(http.StatusUnauthorized, echo.Map{
-			"error": err.Error(),
-		})
+// parseRunRequest decodes and authorizes the run. Runs which get rejected
+// return errRunRejected, together with the request once it got decoded.
+func (s *server) parseRunRequest(c echo.Context) (*workertypes.WorkerRequestPayload, error) {
+	var req *workertypes.WorkerRequestPayload
+	if err := c.Bind(&req); err != nil || req == nil {
+		return nil, rejectRun("invalid_body", http.StatusBadRequest, "could not decode request body")
 	}
-	log.Printf("Validated turnstile successfully")
-	log.Printf("Obtaining worker")
-	var worker *Worker
-	select {
-	case worker = <-s.workers[req.Language].GetCh():
-	case <-time.After(WORKER_TIMEOUT * time.Second):
-		log.Println("Got Worker timeout, was not able to get a worker!")
-		return c.JSON(http.StatusServiceUnavailable, echo.Map{
-			"error": "Timeout in getting a worker!",
-		})
+	if !req.Language.IsValid() {
+		return nil, rejectRun("invalid_language", http.StatusBadRequest, "could not recognize language")
 	}
-
-	logger := log.WithField("worker-id", worker.id)
-	logger.Infof("Received code: '%s'", req.Code)
-	logger.Info("Obtained worker successfully")
-	logger.Info("Publishing job")
-	if err := worker.Publish(req.Code); err != nil {
-		return fmt.Errorf("could not create new worker job: %w", err)
+	if err := req.ValidateFiles(); err != nil {
+		return req, rejectRun("invalid_files", http.StatusBadRequest, err.Error())
 	}
-	logger.Println("Published message")
-
-	start := time.Now()
 
-	var payload *workertypes.WorkerResponsePayload
-	timeout := false
-	select {
-	case payload = <-worker.Subscribe():
-		payload.Duration = time.Since(start).Milliseconds()
-		logger.Println("Received response successfully")
-	case <-time.After(EXECUTION_TIMEOUT * time.Second):
-		logger.Println("Got execution timeout!")
-		timeout = true
+	logger := logging.FromContext(c.Request().Context()).WithField("language", req.Language)
+	if apiKey := getAPIKey(c); apiKey != nil {
+		if !apiKey.AllowsLanguage(req.Language) {
+			logger.Println("Rejected run of API key for disallowed language")
+			return req, rejectRun("api_key_language", http.StatusForbidden, "API key is not allowed to run this language")
+		}
+		logger.Println("Running via API key")
+		return req, nil
 	}
 
-	go func() {
-		logger.Println("Starting worker cleanup")
-		if err := worker.Cleanup(); err != nil {
-			logger.Printf("could not cleanup worker: %v", err)
-			return
+	logger.Debug("Validating turnstile")
+	if err := s.captchaVerifier.Verify(c.Request().Context(), req.Token, getTurnstileIP(c)); err != nil {
+		logger.Printf("Could not validate turnstile: %v", err)
+		if errors.Is(err, errCaptchaUnavailable) {
+			return req, rejectRun("captcha_unavailable", http.StatusServiceUnavailable, errCaptchaUnavailable.Error())
 		}
-		logger.Println("Finished worker cleanup")
+		return req, rejectRun("captcha", http.StatusUnauthorized, err.Error())
+	}
+	logger.Debug("Validated turnstile successfully")
+	return req, nil
+}
 
-		logger.Println("Adding new worker")
-		if err := s.workers[req.Language].AddWorkers(1); err != nil {
-			logger.Printf("could not create new worker: %v", err)
-			return
-		}
-		logger.Println("Added new worker successfully")
-	}()
+func (s *server) handleRun(c echo.Context) error {
+	req, err := s.parseRunRequest(c)
+	if err != nil {
+		s.auditRun(c.Request().Context(), req, s.clientID(c), nil, err)
+		return jsonError(c, err)
+	}
 
-	if timeout {
-		return c.JSON(http.StatusServiceUnavailable, echo.Map{
-			"error": "Execution timeout!",
-		})
+	payload, err := s.executeRun(c.Request().Context(), req, runOptions{
+		client: s.clientID(c),
+	})
+	if err != nil {
+		return jsonError(c, err)
 	}
 
 	if !payload.Success {
@@ -217,46 +358,142 @@ func (s *server) handleRun(c echo.Context) error {
 	return c.JSON(http.StatusOK, payload)
 }
 
-func (s *server) handleShareGet(c echo.Context) error {
-	ctx := c.Request().Context()
-	id := c.Param("id")
-	resp, err := s.etcdClient.Get(ctx, id)
-	if err != nil {
-		return fmt.Errorf("could not fetch share: %w", err)
-	}
-	if resp.Count == 0 {
-		return fmt.Errorf("no share found")
-	}
-	return c.Blob(http.StatusOK, "application/json", resp.Kvs[0].Value)
+type runOptions struct {
+	// client identifies the caller, the runs of different clients get the
+	// workers in turns.
+	client string
+	// onQueued gets called with the position in the queue while the run is
+	// waiting for a worker.
+	onQueued func(position int)
+	// onStart gets called once the job got published to a worker.
+	onStart func()
+	// onOutput makes the worker stream its output which gets passed to it
+	// while the execution is still in progress.
+	onOutput func(chunk *workertypes.WorkerOutputChunk)
 }
 
-func (s *server) handleShareCreate(c echo.Context) error {
-	ctx := c.Request().Context()
-	code, err := io.ReadAll(http.MaxBytesReader(c.Response().Writer, c.Request().Body, 1<<20))
+// executeRun runs the request on a worker of the requested language and waits
+// for its response. Once ctx is done, the run gets cancelled and its worker
+// pod gets deleted right away.
+func (s *server) executeRun(ctx context.Context, req *workertypes.WorkerRequestPayload, opts runOptions) (payload *workertypes.WorkerResponsePayload, err error) {
+	defer func() {
+		runsTotal.WithLabelValues(string(req.Language), runOutcome(payload, err)).Inc()
+		if payload != nil {
+			runDuration.WithLabelValues(string(req.Language)).Observe(float64(payload.Duration) / 1000)
+		}
+		s.auditRun(ctx, req, opts.client, payload, err)
+	}()
+	logger := logging.FromContext(ctx).WithField("language", req.Language)
+	logger.Info("Obtaining worker")
+	acquireCtx, acquireSpan := tracing.Start(ctx, "acquire worker", trace.WithAttributes(
+		attribute.String("language", string(req.Language)),
+	))
+	worker, err := s.workers[req.Language].Get(acquireCtx, opts.client, QUEUE_TIMEOUT*time.Second, opts.onQueued)
+	tracing.EndSpan(acquireSpan, err)
 	if err != nil {
-		return fmt.Errorf("could not read request body: %w", err)
+		logger.Printf("Could not obtain a worker: %v", err)
+		return nil, err
 	}
-	for retryCount := 0; retryCount <= 3; retryCount++ {
-		id := generateRandomString(SNIPPET_ID_LENGTH)
-		resp, err := s.etcdClient.Get(ctx, id)
-		if err != nil {
-			return fmt.Errorf("could not fetch share: %w", err)
+
+	executeCtx, executeSpan := tracing.Start(logging.WithFields(ctx, log.Fields{"worker-id": worker.id}), "execute", trace.WithAttributes(
+		attribute.String("language", string(req.Language)),
+		attribute.String("worker.id", worker.id),
+	))
+	defer func() {
+		if payload != nil {
+			executeSpan.SetAttributes(
+				attribute.Bool("success", payload.Success),
+				attribute.Int("exit_code", payload.ExitCode),
+			)
 		}
-		if resp.Count == 0 {
-			_, err = s.etcdClient.Put(ctx, id, string(code))
-			if err != nil {
-				return fmt.Errorf("could not save share: %w", err)
+		tracing.EndSpan(executeSpan, err)
+	}()
+
+	logger = logger.WithField("worker-id", worker.id)
+	logger.WithFields(logging.CodeFields(req.Code)).Info("Obtained worker successfully")
+	logger.Info("Publishing job")
+	if err := worker.Publish(executeCtx, &workertypes.WorkerRequestPayload{
+		Code:     req.Code,
+		Language: req.Language,
+		Stream:   opts.onOutput != nil,
+		Files:    req.Files,
+		Timeout:  (EXECUTION_TIMEOUT - WORKER_EXECUTION_TIMEOUT_MARGIN) * 1000,
+	}); err != nil {
+		// The worker might have received the job anyways, so it can't be reused
+		go releaseWorker(logger, worker)
+		return nil, fmt.Errorf("could not create new worker job: %w", err)
+	}
+	logger.Println("Published message")
+	if opts.onStart != nil {
+		opts.onStart()
+	}
+
+	start := time.Now()
+
+	var runErr error
+	executionTimeout := time.After(EXECUTION_TIMEOUT * time.Second)
+	outputs := worker.SubscribeOutput()
+waitForReply:
+	for {
+		select {
+		case chunk := <-outputs:
+			if opts.onOutput != nil {
+				opts.onOutput(chunk)
 			}
-			return c.JSON(http.StatusCreated, echo.Map{
-				"key": id,
-			})
+		case payload = <-worker.Subscribe():
+			payload.Duration = time.Since(start).Milliseconds()
+			logger.Println("Received response successfully")
+			break waitForReply
+		case <-worker.Died():
+			logger.Println("Worker died during the execution!")
+			runErr = errWorkerDied
+			break waitForReply
+		case <-executionTimeout:
+			logger.Println("Got execution timeout!")
+			runErr = errExecutionTimeout
+			break waitForReply
+		case <-ctx.Done():
+			logger.Println("Run got cancelled!")
+			runErr = errRunCancelled
+			break waitForReply
 		}
 	}
-	return errors.New("could not generate a key")
+	// Chunks which were published before the reply might still be buffered
+	for opts.onOutput != nil && len(outputs) > 0 {
+		opts.onOutput(<-outputs)
+	}
+
+	go releaseWorker(logger, worker)
+
+	if runErr != nil {
+		return nil, runErr
+	}
+	return payload, nil
+}
+
+// releaseWorker deletes a worker which got handed out for a run and replaces
+// it in the warm pool.
+func releaseWorker(logger *log.Entry, worker *Worker) {
+	logger.Println("Starting worker cleanup")
+	if err := worker.Cleanup(); err != nil {
+		logger.Printf("could not cleanup worker: %v", err)
+		return
+	}
+	logger.Println("Finished worker cleanup")
+
+	logger.Println("Adding new worker")
+	if err := worker.workers.Replenish(); err != nil {
+		logger.Printf("could not create new worker: %v", err)
+		return
+	}
+	logger.Println("Added new worker successfully")
 }
 
 func (s *server) handleHealth(c echo.Context) error {
 	ctx := c.Request().Context()
+	if s.etcdClient == nil {
+		return c.String(http.StatusOK, "OK")
+	}
 	for _, endpoint := range s.etcdClient.Endpoints() {
 		if _, err := s.etcdClient.Status(ctx, endpoint); err != nil {
 			return fmt.Errorf("could not check etcd status: %w", err)
@@ -265,6 +502,18 @@ func (s *server) handleHealth(c echo.Context) error {
 	return c.String(http.StatusOK, "OK")
 }
 
+// handleStatus reports the queue depth and warm workers of each language on
+// this replica.
+func (s *server) handleStatus(c echo.Context) error {
+	languages := map[workertypes.WorkerLanguage]PoolStatus{}
+	for language, workers := range s.workers {
+		languages[language] = workers.Status()
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"languages": languages,
+	})
+}
+
 func (s *server) ListenAndServe() error {
 	return s.server.Start(fmt.Sprintf(":%s", os.Getenv("CONTROL_HTTP_PORT")))
 }
@@ -273,6 +522,10 @@ func (s *server) Stop() error {
 	if err := s.server.Shutdown(context.Background()); err != nil {
 		return fmt.Errorf("could not shutdown server: %w", err)
 	}
+	close(s.stopReconciler)
+	if s.stopImageWatch != nil {
+		s.stopImageWatch()
+	}
 	for language := range s.workers {
 		if err := s.workers[language].Cleanup(); err != nil {
 			return fmt.Errorf("could not cleanup workers: %w", err)
@@ -281,10 +534,19 @@ func (s *server) Stop() error {
 	if err := s.amqpConnection.Close(); err != nil {
 		return fmt.Errorf("could not close amqp connection: %w", err)
 	}
+	if err := s.shutdownTracing(context.Background()); err != nil {
+		return fmt.Errorf("could not shutdown tracing: %w", err)
+	}
+	if s.etcdClient == nil {
+		return nil
+	}
 	return s.etcdClient.Close()
 }
 
 func main() {
+	if err := logging.Setup("control-service"); err != nil {
+		log.Fatalf("could not setup logging: %v", err)
+	}
 	s, err := newServer()
 	if err != nil {
 		log.Fatalf("could not init server: %v", err)
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+)
+
+// fakeCaptchaVerifier returns err for all tokens and records them.
+type fakeCaptchaVerifier struct {
+	err       error
+	tokens    []string
+	remoteIPs []string
+}
+
+func (f *fakeCaptchaVerifier) Verify(ctx context.Context, token string, remoteIP string) error {
+	f.tokens = append(f.tokens, token)
+	f.remoteIPs = append(f.remoteIPs, remoteIP)
+	return f.err
+}
+
+// newTestWorkers returns a pool without workers, runs only get as far as
+// waiting for one.
+func newTestWorkers(language workertypes.WorkerLanguage) *Workers {
+	return &Workers{language: language, queue: newFairQueue()}
+}
+
+func newTestServer(verifier CaptchaVerifier) *server {
+	return &server{
+		captchaVerifier: verifier,
+		workers: map[workertypes.WorkerLanguage]*Workers{
+			workertypes.WorkerLanguagePython: newTestWorkers(workertypes.WorkerLanguagePython),
+		},
+	}
+}
+
+// serveRun calls handleRun with the body. The request context is cancelled
+// already, so accepted runs stop while waiting for a worker.
+func serveRun(t *testing.T, s *server, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/service/control/run", strings.NewReader(body)).WithContext(ctx)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("CF-Connecting-IP", "203.0.113.1")
+	rec := httptest.NewRecorder()
+	e := echo.New()
+	c := e.NewContext(req, rec)
+	if err := s.handleRun(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+func TestHandleRunCaptcha(t *testing.T) {
+	body := `{"code": "print(1)", "language": "python", "token": "token"}`
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{name: "accepted", status: StatusClientClosedRequest},
+		{name: "rejected", err: fmt.Errorf("%w: invalid-input-response", errCaptchaRejected), status: http.StatusUnauthorized},
+		{name: "unavailable", err: fmt.Errorf("%w: internal-error", errCaptchaUnavailable), status: http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := &fakeCaptchaVerifier{err: test.err}
+			rec := serveRun(t, newTestServer(verifier), body)
+			if rec.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, rec.Code, rec.Body)
+			}
+			if len(verifier.tokens) != 1 || verifier.tokens[0] != "token" || verifier.remoteIPs[0] != "203.0.113.1" {
+				t.Errorf("expected the token to be verified once for the client IP, got tokens %v and IPs %v", verifier.tokens, verifier.remoteIPs)
+			}
+		})
+	}
+}
+
+func TestHandleRunNoopCaptcha(t *testing.T) {
+	rec := serveRun(t, newTestServer(noopCaptchaVerifier{}), `{"code": "print(1)", "language": "python"}`)
+	if rec.Code != StatusClientClosedRequest {
+		t.Fatalf("expected the run to wait for a worker, got status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestHandleRunInvalidRequest(t *testing.T) {
+	verifier := &fakeCaptchaVerifier{}
+	rec := serveRun(t, newTestServer(verifier), `{"code": "print(1)", "language": "cobol", "token": "token"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body)
+	}
+	if len(verifier.tokens) != 0 {
+		t.Errorf("expected invalid requests to not be verified")
+	}
+}
+
+func TestHandleRunAudit(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		err        error
+		outcome    string
+		errorClass string
+		language   workertypes.WorkerLanguage
+	}{
+		{name: "cancelled", body: `{"code": "print(1)", "language": "python"}`, outcome: "cancelled", errorClass: "cancelled", language: workertypes.WorkerLanguagePython},
+		{name: "invalid language", body: `{"code": "print(1)", "language": "cobol"}`, outcome: "rejected", errorClass: "invalid_language"},
+		{name: "invalid files", body: `{"code": "print(1)", "language": "python", "files": {"../main.py": ""}}`, outcome: "rejected", errorClass: "invalid_files", language: workertypes.WorkerLanguagePython},
+		{name: "captcha", body: `{"code": "print(1)", "language": "python"}`, err: errCaptchaRejected, outcome: "rejected", errorClass: "captcha", language: workertypes.WorkerLanguagePython},
+		{name: "captcha unavailable", body: `{"code": "print(1)", "language": "python"}`, err: errCaptchaUnavailable, outcome: "rejected", errorClass: "captcha_unavailable", language: workertypes.WorkerLanguagePython},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(&fakeCaptchaVerifier{err: test.err})
+			store := &memoryAuditStore{retention: time.Hour}
+			s.auditStore = store
+			serveRun(t, s, test.body)
+
+			// The records get appended in the background
+			var records []*AuditRecord
+			for deadline := time.Now().Add(5 * time.Second); len(records) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				var err error
+				records, err = store.Query(context.Background(), AuditQuery{To: time.Now().Add(time.Hour), Limit: 10})
+				if err != nil {
+					t.Fatalf("could not query audit records: %v", err)
+				}
+			}
+			if len(records) != 1 {
+				t.Fatalf("expected 1 audit record, got %d", len(records))
+			}
+			record := records[0]
+			if record.Outcome != test.outcome || record.ErrorClass != test.errorClass {
+				t.Errorf("expected outcome %q with error class %q, got %q with %q", test.outcome, test.errorClass, record.Outcome, record.ErrorClass)
+			}
+			if record.Language != test.language {
+				t.Errorf("expected language %q, got %q", test.language, record.Language)
+			}
+			if record.ClientHash != hashAuditClient("ip:203.0.113.1") {
+				t.Errorf("expected the client to be recorded")
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const METRICS_NAMESPACE = "try_playwright_control"
+
+var (
+	runsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "runs_total",
+		Help:      "Runs by language and outcome.",
+	}, []string{"language", "outcome"})
+	runDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "run_duration_seconds",
+		Help:      "Execution duration of the runs which got a reply from their worker.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 20, 30, 45, 60},
+	}, []string{"language"})
+	workerAcquisitionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "worker_acquisition_seconds",
+		Help:      "How long runs waited for a worker.",
+		Buckets:   []float64{0.01, 0.1, 0.5, 1, 2.5, 5, 10, 20, 30, 60},
+	}, []string{"language"})
+	workerStartDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "worker_start_seconds",
+		Help:      "How long the runtime took to create a worker, e.g. its pod.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"language"})
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "rate_limited_total",
+		Help:      "Runs which got rejected because the client exceeded its rate limit.",
+	}, []string{"reason"})
+	sharesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "shares_total",
+		Help:      "Share requests by operation and status code.",
+	}, []string{"operation", "code"})
+)
+
+// runOutcome classifies the result of executeRun for the metrics and the
+// audit log.
+func runOutcome(payload *workertypes.WorkerResponsePayload, err error) string {
+	var rejected *errRunRejected
+	switch {
+	case errors.As(err, &rejected):
+		return "rejected"
+	case errors.Is(err, errWorkerTimeout):
+		return "worker_timeout"
+	case errors.Is(err, errWorkerDied):
+		return "worker_died"
+	case errors.Is(err, errQueueFull):
+		return "queue_full"
+	case errors.Is(err, errPoolDrained):
+		return "drained"
+	case errors.Is(err, errExecutionTimeout):
+		return "timeout"
+	case errors.Is(err, errRunCancelled):
+		return "cancelled"
+	case err != nil:
+		return "error"
+	case payload.TimedOut:
+		return "timeout"
+	case !payload.Success:
+		return "failure"
+	default:
+		return "success"
+	}
+}
+
+// poolCollector exposes the state of the worker pools when they get scraped.
+type poolCollector struct {
+	workers map[workertypes.WorkerLanguage]*Workers
+
+	queued   *prometheus.Desc
+	idle     *prometheus.Desc
+	starting *prometheus.Desc
+	target   *prometheus.Desc
+}
+
+func newPoolCollector(workers map[workertypes.WorkerLanguage]*Workers) *poolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(METRICS_NAMESPACE, "pool", name), help, []string{"language"}, nil)
+	}
+	return &poolCollector{
+		workers:  workers,
+		queued:   desc("queued", "Runs which are waiting for a worker."),
+		idle:     desc("idle_workers", "Warm workers which are waiting for a run."),
+		starting: desc("starting_workers", "Workers which are being created."),
+		target:   desc("target_workers", "Amount of warm workers the autoscaler wants."),
+	}
+}
+
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.queued
+	ch <- p.idle
+	ch <- p.starting
+	ch <- p.target
+}
+
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for language, workers := range p.workers {
+		status := workers.Status()
+		ch <- prometheus.MustNewConstMetric(p.queued, prometheus.GaugeValue, float64(status.Queued), string(language))
+		ch <- prometheus.MustNewConstMetric(p.idle, prometheus.GaugeValue, float64(status.IdleWorkers), string(language))
+		ch <- prometheus.MustNewConstMetric(p.starting, prometheus.GaugeValue, float64(status.Starting), string(language))
+		ch <- prometheus.MustNewConstMetric(p.target, prometheus.GaugeValue, float64(status.Target), string(language))
+	}
+}
+
+// countShares counts the requests of a share operation by their status code.
+func countShares(operation string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			code := c.Response().Status
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				code = httpErr.Code
+			} else if err != nil {
+				code = 500
+			}
+			sharesTotal.WithLabelValues(operation, strconv.Itoa(code)).Inc()
+			return err
+		}
+	}
+}
+
+func metricsHandler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
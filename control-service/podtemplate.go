@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/yaml"
+)
+
+// WORKER_CONTAINER_NAME is the container of the template which runs the
+// worker, it gets added if the template has none.
+const WORKER_CONTAINER_NAME = "worker"
+
+// podTemplateFile is the format of the WORKER_POD_TEMPLATE file. The default
+// template applies to all languages, the language ones get merged into it as
+// a strategic merge patch, like kubectl patch does.
+type podTemplateFile struct {
+	Default   json.RawMessage                                `json:"default"`
+	Languages map[workertypes.WorkerLanguage]json.RawMessage `json:"languages"`
+}
+
+// loadPodTemplates reads the pod templates of all languages from the file
+// at path. Without a path the templates are empty.
+func loadPodTemplates(path string) (map[workertypes.WorkerLanguage]*v1.PodTemplateSpec, error) {
+	templates := map[workertypes.WorkerLanguage]*v1.PodTemplateSpec{}
+	file := podTemplateFile{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read pod template: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &file); err != nil {
+			return nil, fmt.Errorf("could not parse pod template: %w", err)
+		}
+	}
+	for language := range file.Languages {
+		if !slices.Contains(workertypes.SUPPORTED_LANGUAGES, language) {
+			return nil, fmt.Errorf("pod template for unknown language: %s", language)
+		}
+	}
+	base := file.Default
+	if len(base) == 0 || bytes.Equal(base, []byte("null")) {
+		base = []byte("{}")
+	}
+	for _, language := range workertypes.SUPPORTED_LANGUAGES {
+		merged := base
+		if override, ok := file.Languages[language]; ok && !bytes.Equal(override, []byte("null")) {
+			var err error
+			merged, err = strategicpatch.StrategicMergePatch(base, override, v1.PodTemplateSpec{})
+			if err != nil {
+				return nil, fmt.Errorf("could not merge %s pod template: %w", language, err)
+			}
+		}
+		template := &v1.PodTemplateSpec{}
+		decoder := json.NewDecoder(bytes.NewReader(merged))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(template); err != nil {
+			return nil, fmt.Errorf("could not decode %s pod template: %w", language, err)
+		}
+		templates[language] = template
+	}
+	return templates, nil
+}
+
+// buildPod creates the pod of the worker from the template of its language.
+// The fields the pool relies on are always set, env vars and resources only
+// if the template does not set them.
+func buildPod(template *v1.PodTemplateSpec, worker *Worker, labels map[string]string) *v1.Pod {
+	template = template.DeepCopy()
+	pod := &v1.Pod{
+		ObjectMeta: template.ObjectMeta,
+		Spec:       template.Spec,
+	}
+	pod.Name = ""
+	pod.GenerateName = fmt.Sprintf("worker-%s-", worker.language)
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	for name, value := range labels {
+		pod.Labels[name] = value
+	}
+	// The pool replaces dead workers itself, so they must not restart
+	pod.Spec.RestartPolicy = v1.RestartPolicyNever
+	if pod.Spec.AutomountServiceAccountToken == nil {
+		pod.Spec.AutomountServiceAccountToken = ptr.To(false)
+	}
+	if pod.Spec.EnableServiceLinks == nil {
+		pod.Spec.EnableServiceLinks = ptr.To(false)
+	}
+
+	container := workerContainer(&pod.Spec)
+	container.Image = worker.image
+	if container.ImagePullPolicy == "" {
+		container.ImagePullPolicy = v1.PullIfNotPresent
+	}
+	env := workerEnv(worker)
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		idx := slices.IndexFunc(container.Env, func(envVar v1.EnvVar) bool {
+			return envVar.Name == name
+		})
+		switch {
+		case idx < 0:
+			container.Env = append(container.Env, v1.EnvVar{Name: name, Value: env[name]})
+		case name == "WORKER_ID":
+			// The worker consumes the queue named after its id
+			container.Env[idx] = v1.EnvVar{Name: name, Value: env[name]}
+		}
+	}
+	setResourceDefaults(&container.Resources)
+	applySecurityDefaults(pod, container, worker.language)
+	return pod
+}
+
+func workerContainer(spec *v1.PodSpec) *v1.Container {
+	for i := range spec.Containers {
+		if spec.Containers[i].Name == WORKER_CONTAINER_NAME {
+			return &spec.Containers[i]
+		}
+	}
+	spec.Containers = append(spec.Containers, v1.Container{Name: WORKER_CONTAINER_NAME})
+	return &spec.Containers[len(spec.Containers)-1]
+}
+
+func setResourceDefaults(resources *v1.ResourceRequirements) {
+	setResourceListDefaults(&resources.Limits, v1.ResourceList{
+		v1.ResourceMemory:           resource.MustParse("1024Mi"),
+		v1.ResourceCPU:              resource.MustParse("1000m"),
+		v1.ResourceEphemeralStorage: resource.MustParse("512Mi"),
+	})
+	setResourceListDefaults(&resources.Requests, v1.ResourceList{
+		v1.ResourceMemory:           resource.MustParse("64Mi"),
+		v1.ResourceCPU:              resource.MustParse("100m"),
+		v1.ResourceEphemeralStorage: resource.MustParse("64Mi"),
+	})
+}
+
+func setResourceListDefaults(list *v1.ResourceList, defaults v1.ResourceList) {
+	if *list == nil {
+		*list = v1.ResourceList{}
+	}
+	for name, quantity := range defaults {
+		if _, ok := (*list)[name]; !ok {
+			(*list)[name] = quantity
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	log "github.com/sirupsen/logrus"
+)
+
+// WORKER_READY_TIMEOUT is how long a replacement worker may take to become
+// ready before it is given up.
+const WORKER_READY_TIMEOUT = 3 * time.Minute
+
+func (h workerHealth) String() string {
+	switch h {
+	case workerHealthReady:
+		return "ready"
+	case workerHealthDead:
+		return "dead"
+	default:
+		return "starting"
+	}
+}
+
+// workerRun describes the run which a worker is executing.
+type workerRun struct {
+	client    string
+	requestID string
+	startedAt time.Time
+}
+
+// markInFlight records that the worker got handed out for a run.
+func (w *Workers) markInFlight(ctx context.Context, worker *Worker, client string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	worker.run = &workerRun{
+		client:    client,
+		requestID: logging.RequestID(ctx),
+		startedAt: time.Now(),
+	}
+	w.inFlight[worker.id] = worker
+}
+
+func (w *Workers) isInFlight(worker *Worker) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.inFlight[worker.id]
+	return ok
+}
+
+func (w *Workers) removeInFlight(worker *Worker) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.inFlight, worker.id)
+}
+
+// Drain removes the warm workers and rejects the runs which wait for a
+// worker and new ones until Resume gets called. The runs in flight get
+// finished.
+func (w *Workers) Drain() {
+	w.mu.Lock()
+	if w.draining {
+		w.mu.Unlock()
+		return
+	}
+	w.draining = true
+	close(w.drained)
+	idle := w.idle
+	w.idle = nil
+	w.mu.Unlock()
+	log.WithField("language", w.language).Printf("Draining %d warm workers", len(idle))
+	for _, worker := range idle {
+		if err := worker.Cleanup(); err != nil {
+			log.WithField("worker-id", worker.id).Printf("could not cleanup drained worker: %v", err)
+		}
+	}
+}
+
+// Resume accepts runs again after Drain and refills the warm pool in the
+// background.
+func (w *Workers) Resume() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.draining {
+		return
+	}
+	w.draining = false
+	w.drained = make(chan struct{})
+	go w.scale()
+}
+
+// Recycle replaces the current warm workers with new ones, e.g. to pick up a
+// new image.
+func (w *Workers) Recycle() {
+	w.replaceMu.Lock()
+	defer w.replaceMu.Unlock()
+	w.mu.Lock()
+	idle := slices.Clone(w.idle)
+	w.mu.Unlock()
+	w.replaceIdle(func(worker *Worker) bool {
+		return slices.Contains(idle, worker)
+	})
+}
+
+// replaceIdle replaces the warm workers which match one by one. Each new
+// worker gets started before the old one gets removed and the next one only
+// gets replaced once it is ready, so the capacity never drops. If a new worker
+// does not become ready, the old one is kept and the replacement stops.
+// Workers which are in flight finish their run and get replaced afterwards
+// anyways.
+func (w *Workers) replaceIdle(match func(worker *Worker) bool) {
+	logger := log.WithField("language", w.language)
+	replaced := 0
+	for !w.isDraining() {
+		old := w.findIdle(match)
+		if old == nil {
+			break
+		}
+		if !w.surge(w.images.Image(w.language)) {
+			logger.Error("Replacement worker did not become ready, keeping the remaining warm workers")
+			break
+		}
+		if w.retire(old) {
+			replaced++
+		}
+	}
+	// Workers which got handed out meanwhile leave surplus new ones behind
+	w.shrink()
+	logger.Printf("Replaced %d warm workers", replaced)
+}
+
+// surge adds a worker with the image to the warm pool and reports whether it
+// became ready. A worker which did not gets removed again.
+func (w *Workers) surge(image string) bool {
+	logger := log.WithField("language", w.language)
+	w.starting.Add(1)
+	worker, err := newWorker(w, image)
+	w.starting.Add(-1)
+	if err != nil {
+		logger.Errorf("could not create worker: %v", err)
+		return false
+	}
+	if !w.put(worker) {
+		if err := worker.Cleanup(); err != nil {
+			logger.Printf("could not cleanup surplus worker: %v", err)
+		}
+		return false
+	}
+	if !w.waitUntilReady(worker, WORKER_READY_TIMEOUT) {
+		// A worker which got handed out meanwhile is cleaned up after its run
+		if w.removeIdle(worker) {
+			if err := worker.Cleanup(); err != nil {
+				logger.Printf("could not cleanup worker: %v", err)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// retire removes a warm worker and reports whether it was still warm.
+func (w *Workers) retire(worker *Worker) bool {
+	if !w.removeIdle(worker) {
+		return false
+	}
+	if err := worker.Cleanup(); err != nil {
+		log.WithField("worker-id", worker.id).Printf("could not cleanup replaced worker: %v", err)
+	}
+	return true
+}
+
+// findIdle returns the oldest warm worker which matches.
+func (w *Workers) findIdle(match func(worker *Worker) bool) *Worker {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, worker := range w.idle {
+		if match(worker) {
+			return worker
+		}
+	}
+	return nil
+}
+
+// waitUntilReady waits up to timeout for the worker to start and reports
+// whether it became ready.
+func (w *Workers) waitUntilReady(worker *Worker, timeout time.Duration) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		switch worker.health() {
+		case workerHealthReady:
+			return true
+		case workerHealthDead:
+			return false
+		}
+		select {
+		case <-w.stop:
+			return false
+		case <-deadline:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// Resize changes the range of the autoscaler and scales the warm pool into
+// it in the background.
+func (w *Workers) Resize(size PoolSize) error {
+	if err := size.Validate(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.size = size
+	w.target = max(size.Min, min(size.Max, w.target))
+	log.WithField("language", w.language).Printf("Resized warm pool to %d-%d workers", size.Min, size.Max)
+	go w.scale()
+	return nil
+}
+
+// scale adds or removes warm workers until the pool matches its target.
+func (w *Workers) scale() {
+	if w.warmCount() > w.Target() {
+		w.shrink()
+		return
+	}
+	if err := w.Replenish(); err != nil {
+		log.WithField("language", w.language).Printf("could not scale warm pool: %v", err)
+	}
+}
+
+type poolWorker struct {
+	ID string `json:"id"`
+	// Pod is the name of the pod, or the container or process of the other
+	// runtimes.
+	Pod   string  `json:"pod"`
+	Age   float64 `json:"age"`
+	Phase string  `json:"phase"`
+}
+
+type poolRun struct {
+	WorkerID   string    `json:"workerId"`
+	Pod        string    `json:"pod"`
+	ClientHash string    `json:"clientHash"`
+	RequestID  string    `json:"requestId,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+}
+
+// PoolDetails is the state of a pool for the admin API.
+type PoolDetails struct {
+	PoolStatus
+	Size     PoolSize     `json:"size"`
+	Draining bool         `json:"draining"`
+	Workers  []poolWorker `json:"workers"`
+	Runs     []poolRun    `json:"runs"`
+}
+
+func (w *Workers) Details() PoolDetails {
+	status := w.Status()
+	w.mu.Lock()
+	idle := slices.Clone(w.idle)
+	details := PoolDetails{
+		PoolStatus: status,
+		Size:       w.size,
+		Draining:   w.draining,
+		Workers:    []poolWorker{},
+		Runs:       []poolRun{},
+	}
+	for _, worker := range w.inFlight {
+		details.Runs = append(details.Runs, poolRun{
+			WorkerID:   worker.id,
+			Pod:        worker.handle,
+			ClientHash: hashAuditClient(worker.run.client),
+			RequestID:  worker.run.requestID,
+			StartedAt:  worker.run.startedAt,
+		})
+	}
+	w.mu.Unlock()
+	slices.SortFunc(details.Runs, func(a, b poolRun) int {
+		return a.StartedAt.Compare(b.StartedAt)
+	})
+	// The health might be looked up via the runtime, so not under the lock
+	for _, worker := range idle {
+		details.Workers = append(details.Workers, poolWorker{
+			ID:    worker.id,
+			Pod:   worker.handle,
+			Age:   time.Since(worker.createdAt).Seconds(),
+			Phase: worker.health().String(),
+		})
+	}
+	return details
+}
+
+var errUnknownPool = echo.NewHTTPError(http.StatusNotFound, "unknown language")
+
+// pool returns the pool of the language in the path.
+func (s *server) pool(c echo.Context) (*Workers, error) {
+	workers, ok := s.workers[workertypes.WorkerLanguage(c.Param("language"))]
+	if !ok {
+		return nil, errUnknownPool
+	}
+	return workers, nil
+}
+
+func (s *server) handlePoolList(c echo.Context) error {
+	languages := map[workertypes.WorkerLanguage]PoolDetails{}
+	for language, workers := range s.workers {
+		languages[language] = workers.Details()
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"languages": languages,
+	})
+}
+
+func (s *server) handlePoolGet(c echo.Context) error {
+	workers, err := s.pool(c)
+	if err != nil {
+		return jsonError(c, err)
+	}
+	return c.JSON(http.StatusOK, workers.Details())
+}
+
+func (s *server) handlePoolDrain(c echo.Context) error {
+	workers, err := s.pool(c)
+	if err != nil {
+		return jsonError(c, err)
+	}
+	workers.Drain()
+	return c.JSON(http.StatusOK, workers.Details())
+}
+
+func (s *server) handlePoolResume(c echo.Context) error {
+	workers, err := s.pool(c)
+	if err != nil {
+		return jsonError(c, err)
+	}
+	workers.Resume()
+	return c.JSON(http.StatusOK, workers.Details())
+}
+
+// handlePoolRecycle replaces the warm workers in the background, since
+// starting them takes a while.
+func (s *server) handlePoolRecycle(c echo.Context) error {
+	workers, err := s.pool(c)
+	if err != nil {
+		return jsonError(c, err)
+	}
+	go workers.Recycle()
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (s *server) handlePoolResize(c echo.Context) error {
+	workers, err := s.pool(c)
+	if err != nil {
+		return jsonError(c, err)
+	}
+	var size *PoolSize
+	if err := c.Bind(&size); err != nil || size == nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "could not decode request body",
+		})
+	}
+	if err := workers.Resize(*size); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, workers.Details())
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"slices"
+)
+
+// DEFAULT_MAX_QUEUE_LENGTH is how many runs per language can wait for a
+// worker, further runs get rejected right away.
+const DEFAULT_MAX_QUEUE_LENGTH = 50
+
+// waiter is a Get call which waits for a warm worker.
+type waiter struct {
+	client string
+	worker chan *Worker
+	// position receives the latest 1-based position in the queue.
+	position     chan int
+	lastPosition int
+}
+
+func newWaiter(client string) *waiter {
+	return &waiter{
+		client:   client,
+		worker:   make(chan *Worker, 1),
+		position: make(chan int, 1),
+	}
+}
+
+// notifyPosition sends the position without blocking, a position which the
+// waiter did not receive yet gets replaced.
+func (w *waiter) notifyPosition(position int) {
+	if position == w.lastPosition {
+		return
+	}
+	w.lastPosition = position
+	select {
+	case <-w.position:
+	default:
+	}
+	w.position <- position
+}
+
+// fairQueue hands out the workers round-robin between the clients and in
+// arrival order per client, so a single client can't starve the others.
+type fairQueue struct {
+	// clients are the clients with waiters in the order they get served.
+	clients []string
+	waiters map[string][]*waiter
+	length  int
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{
+		waiters: map[string][]*waiter{},
+	}
+}
+
+func (q *fairQueue) Len() int {
+	return q.length
+}
+
+// push adds the waiter to the end of the queue of its client, or to its front
+// if the waiter got a worker already which could not be used.
+func (q *fairQueue) push(w *waiter, front bool) {
+	waiters, ok := q.waiters[w.client]
+	if !ok {
+		q.clients = append(q.clients, w.client)
+	}
+	if front {
+		q.waiters[w.client] = append([]*waiter{w}, waiters...)
+	} else {
+		q.waiters[w.client] = append(waiters, w)
+	}
+	q.length++
+}
+
+// pop removes the next waiter, its client moves to the end of the round.
+func (q *fairQueue) pop() *waiter {
+	if q.length == 0 {
+		return nil
+	}
+	client := q.clients[0]
+	q.clients = q.clients[1:]
+	waiters := q.waiters[client]
+	next := waiters[0]
+	if len(waiters) > 1 {
+		q.waiters[client] = waiters[1:]
+		q.clients = append(q.clients, client)
+	} else {
+		delete(q.waiters, client)
+	}
+	q.length--
+	return next
+}
+
+// remove reports whether the waiter was part of the queue.
+func (q *fairQueue) remove(w *waiter) bool {
+	waiters := q.waiters[w.client]
+	idx := slices.Index(waiters, w)
+	if idx < 0 {
+		return false
+	}
+	waiters = slices.Delete(waiters, idx, idx+1)
+	if len(waiters) == 0 {
+		delete(q.waiters, w.client)
+		q.clients = slices.DeleteFunc(q.clients, func(client string) bool {
+			return client == w.client
+		})
+	} else {
+		q.waiters[w.client] = waiters
+	}
+	q.length--
+	return true
+}
+
+// notifyPositions tells the waiters their current position. In each round
+// every client gets one worker, so the k-th waiter of a client is served
+// after the first k waiters of all clients and the k-th waiters of the
+// clients which come before it in the round.
+func (q *fairQueue) notifyPositions() {
+	for round, client := range q.clients {
+		for k, w := range q.waiters[client] {
+			position := 1
+			for other, otherClient := range q.clients {
+				otherLength := len(q.waiters[otherClient])
+				position += min(otherLength, k)
+				if other < round && otherLength > k {
+					position++
+				}
+			}
+			w.notifyPosition(position)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	DEFAULT_RATE_LIMIT_RUNS_PER_MINUTE = 60
+	DEFAULT_RATE_LIMIT_BURST           = 20
+	DEFAULT_RATE_LIMIT_MAX_CONCURRENT  = 2
+	// RATE_LIMIT_RUN_EXPIRY is after how long a run is not counted as running
+	// anymore, in case the replica which executed it went away.
+	RATE_LIMIT_RUN_EXPIRY = (QUEUE_TIMEOUT + EXECUTION_TIMEOUT + 30) * time.Second
+
+	rateLimitReleaseContextKey = "rateLimitRelease"
+)
+
+// RateLimit configures how many runs a client can start. A rate of zero
+// disables the token bucket, a max concurrency of zero disables the
+// concurrency limit.
+type RateLimit struct {
+	// Rate is the amount of runs per second which get refilled.
+	Rate          float64
+	Burst         float64
+	MaxConcurrent int
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0 || l.MaxConcurrent > 0
+}
+
+// rateLimitFromEnv reads the rate limit from the RATE_LIMIT_* env vars.
+func rateLimitFromEnv() (RateLimit, error) {
+	values := map[string]int{
+		"RATE_LIMIT_RUNS_PER_MINUTE": DEFAULT_RATE_LIMIT_RUNS_PER_MINUTE,
+		"RATE_LIMIT_BURST":           DEFAULT_RATE_LIMIT_BURST,
+		"RATE_LIMIT_MAX_CONCURRENT":  DEFAULT_RATE_LIMIT_MAX_CONCURRENT,
+	}
+	for name := range values {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return RateLimit{}, fmt.Errorf("could not parse '%s' env var: %w", name, err)
+		}
+		if parsed < 0 {
+			return RateLimit{}, fmt.Errorf("'%s' env var must not be negative", name)
+		}
+		values[name] = parsed
+	}
+	// An empty bucket would reject every run instead of disabling the limit
+	if values["RATE_LIMIT_RUNS_PER_MINUTE"] > 0 && values["RATE_LIMIT_BURST"] < 1 {
+		return RateLimit{}, errors.New("'RATE_LIMIT_BURST' env var must be at least 1 unless 'RATE_LIMIT_RUNS_PER_MINUTE' is 0")
+	}
+	return RateLimit{
+		Rate:          float64(values["RATE_LIMIT_RUNS_PER_MINUTE"]) / 60,
+		Burst:         float64(values["RATE_LIMIT_BURST"]),
+		MaxConcurrent: values["RATE_LIMIT_MAX_CONCURRENT"],
+	}, nil
+}
+
+// clientQuota is the rate limiting state of a client.
+type clientQuota struct {
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Runs are the start times of the running runs by their id.
+	Runs map[string]time.Time `json:"runs,omitempty"`
+}
+
+// newClientQuota returns the state of a client which was not seen before.
+func newClientQuota(limit RateLimit, now time.Time) *clientQuota {
+	return &clientQuota{
+		Tokens:    limit.Burst,
+		UpdatedAt: now,
+	}
+}
+
+// refill adds the tokens since the last update and forgets expired runs.
+func (q *clientQuota) refill(limit RateLimit, now time.Time) {
+	if elapsed := now.Sub(q.UpdatedAt); elapsed > 0 {
+		q.Tokens = math.Min(limit.Burst, q.Tokens+elapsed.Seconds()*limit.Rate)
+	}
+	q.UpdatedAt = now
+	for id, startedAt := range q.Runs {
+		if now.Sub(startedAt) > RATE_LIMIT_RUN_EXPIRY {
+			delete(q.Runs, id)
+		}
+	}
+}
+
+// idle reports whether the state equals the one of a new client, so it
+// doesn't have to be stored.
+func (q *clientQuota) idle(limit RateLimit) bool {
+	return len(q.Runs) == 0 && q.Tokens >= limit.Burst
+}
+
+// errRateLimited is returned when a client exceeds its quota.
+type errRateLimited struct {
+	reason     string
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *errRateLimited) Error() string {
+	return e.message
+}
+
+// acquire takes a token and registers the run or returns errRateLimited.
+func (q *clientQuota) acquire(limit RateLimit, runID string, now time.Time) error {
+	q.refill(limit, now)
+	if limit.MaxConcurrent > 0 && len(q.Runs) >= limit.MaxConcurrent {
+		return &errRateLimited{
+			reason:     "concurrency",
+			message:    "Too many concurrent runs!",
+			retryAfter: time.Second,
+		}
+	}
+	if limit.Rate > 0 {
+		if q.Tokens < 1 {
+			return &errRateLimited{
+				reason:     "rate",
+				message:    "Too many runs, try again later!",
+				retryAfter: time.Duration((1 - q.Tokens) / limit.Rate * float64(time.Second)),
+			}
+		}
+		q.Tokens--
+	}
+	if q.Runs == nil {
+		q.Runs = map[string]time.Time{}
+	}
+	q.Runs[runID] = now
+	return nil
+}
+
+// RateLimitStore persists the quotas of the clients.
+type RateLimitStore interface {
+	// Update applies fn atomically to the quota of the client. The quota is
+	// not saved if fn returns an error.
+	Update(ctx context.Context, client string, limit RateLimit, fn func(quota *clientQuota) error) error
+}
+
+// newRateLimitStore creates the store which is configured via the
+// RATE_LIMIT_STORE env var. It defaults to etcd if available, so the limits
+// are shared by all replicas.
+func newRateLimitStore(etcdClient *clientv3.Client) (RateLimitStore, error) {
+	kind := os.Getenv("RATE_LIMIT_STORE")
+	if kind == "" {
+		kind = "memory"
+		if etcdClient != nil {
+			kind = "etcd"
+		}
+	}
+	switch kind {
+	case "etcd":
+		if etcdClient == nil {
+			return nil, errors.New("etcd rate limit store requires 'ETCD_ENDPOINT' env var")
+		}
+		return &etcdRateLimitStore{client: etcdClient}, nil
+	case "memory":
+		return newMemoryRateLimitStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store: %s", kind)
+	}
+}
+
+type memoryRateLimitStore struct {
+	mu     sync.Mutex
+	quotas map[string]*clientQuota
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		quotas: map[string]*clientQuota{},
+	}
+}
+
+func (m *memoryRateLimitStore) Update(ctx context.Context, client string, limit RateLimit, fn func(quota *clientQuota) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	quota, ok := m.quotas[client]
+	if !ok {
+		quota = newClientQuota(limit, time.Now())
+	}
+	// Work on a copy, so a failing fn doesn't change the quota
+	updated := *quota
+	updated.Runs = make(map[string]time.Time, len(quota.Runs))
+	for id, startedAt := range quota.Runs {
+		updated.Runs[id] = startedAt
+	}
+	if err := fn(&updated); err != nil {
+		return err
+	}
+	if updated.idle(limit) {
+		delete(m.quotas, client)
+	} else {
+		m.quotas[client] = &updated
+	}
+	return nil
+}
+
+// rateLimitClient returns the key by which the client gets rate limited and
+// its limit. API keys are limited on their own and can have custom quotas.
+func (s *server) rateLimitClient(c echo.Context) (string, RateLimit) {
+	if apiKey := getAPIKey(c); apiKey != nil {
+		return s.clientID(c), apiKey.Quota.apply(s.rateLimit)
+	}
+	return s.clientID(c), s.rateLimit
+}
+
+// rateLimitRuns limits the runs a client can start and how many of them can
+// run at the same time. Handlers which keep running after the response, like
+// jobs, take over releasing the run via takeRateLimitRelease.
+func (s *server) rateLimitRuns(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		client, limit := s.rateLimitClient(c)
+		if !limit.Enabled() {
+			return next(c)
+		}
+		logger := logging.FromContext(c.Request().Context()).WithField("client", client)
+		runID := uuid.New().String()
+		err := s.rateLimitStore.Update(c.Request().Context(), client, limit, func(quota *clientQuota) error {
+			return quota.acquire(limit, runID, time.Now())
+		})
+		var limitErr *errRateLimited
+		if errors.As(err, &limitErr) {
+			logger.Printf("Rate limited: %s", limitErr.message)
+			rateLimitedTotal.WithLabelValues(limitErr.reason).Inc()
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limitErr.retryAfter.Seconds()))))
+			// The body is not decoded yet, so the record misses the request
+			err := rejectRun("rate_limit:"+limitErr.reason, http.StatusTooManyRequests, limitErr.message)
+			s.auditRun(c.Request().Context(), nil, client, nil, err)
+			return jsonError(c, err)
+		}
+		if err != nil {
+			// Don't lock out everyone because of an unavailable store
+			logger.Printf("could not check rate limit: %v", err)
+			return next(c)
+		}
+
+		var once sync.Once
+		release := func() {
+			once.Do(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := s.rateLimitStore.Update(ctx, client, limit, func(quota *clientQuota) error {
+					quota.refill(limit, time.Now())
+					delete(quota.Runs, runID)
+					return nil
+				}); err != nil {
+					logger.Printf("could not release rate limited run: %v", err)
+				}
+			})
+		}
+		c.Set(rateLimitReleaseContextKey, release)
+		defer func() {
+			if release, ok := c.Get(rateLimitReleaseContextKey).(func()); ok {
+				release()
+			}
+		}()
+		return next(c)
+	}
+}
+
+// takeRateLimitRelease hands the release of the run over to the caller, which
+// has to call it once the run finished.
+func takeRateLimitRelease(c echo.Context) func() {
+	release, ok := c.Get(rateLimitReleaseContextKey).(func())
+	if !ok {
+		return func() {}
+	}
+	c.Set(rateLimitReleaseContextKey, nil)
+	return release
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	RATE_LIMIT_KEY_PREFIX = "ratelimit/"
+	// RATE_LIMIT_LEASE_WINDOW is how long the quotas with the same TTL share a
+	// lease, so not every update needs its own one. They expire up to this
+	// much after their TTL.
+	RATE_LIMIT_LEASE_WINDOW = time.Minute
+	// RATE_LIMIT_MAX_ATTEMPTS bounds the compare-and-swap attempts on a quota
+	// which gets updated by other requests at the same time.
+	RATE_LIMIT_MAX_ATTEMPTS  = 5
+	RATE_LIMIT_RETRY_BACKOFF = 10 * time.Millisecond
+)
+
+type etcdRateLimitLease struct {
+	id        clientv3.LeaseID
+	windowEnd time.Time
+}
+
+type etcdRateLimitStore struct {
+	client *clientv3.Client
+
+	leaseMu sync.Mutex
+	leases  map[int64]etcdRateLimitLease
+}
+
+func (e *etcdRateLimitStore) leaseID(ctx context.Context, ttl int64) (clientv3.LeaseID, error) {
+	e.leaseMu.Lock()
+	defer e.leaseMu.Unlock()
+	if lease, ok := e.leases[ttl]; ok && time.Now().Before(lease.windowEnd) {
+		return lease.id, nil
+	}
+	lease, err := e.client.Grant(ctx, ttl+int64(RATE_LIMIT_LEASE_WINDOW.Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("could not grant lease: %w", err)
+	}
+	if e.leases == nil {
+		e.leases = map[int64]etcdRateLimitLease{}
+	}
+	e.leases[ttl] = etcdRateLimitLease{id: lease.ID, windowEnd: time.Now().Add(RATE_LIMIT_LEASE_WINDOW)}
+	return lease.ID, nil
+}
+
+// Update does a compare-and-swap on the mod revision of the quota and retries
+// with a jittered backoff if another replica updated it in the meantime. Once
+// the attempts are used up, the run gets rate limited.
+func (e *etcdRateLimitStore) Update(ctx context.Context, client string, limit RateLimit, fn func(quota *clientQuota) error) error {
+	key := RATE_LIMIT_KEY_PREFIX + client
+	for attempt := 0; attempt < RATE_LIMIT_MAX_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(rand.N(RATE_LIMIT_RETRY_BACKOFF << attempt)):
+			case <-ctx.Done():
+				return fmt.Errorf("could not save quota: %w", ctx.Err())
+			}
+		}
+		resp, err := e.client.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("could not fetch quota: %w", err)
+		}
+		quota := newClientQuota(limit, time.Now())
+		var modRevision int64
+		if resp.Count > 0 {
+			modRevision = resp.Kvs[0].ModRevision
+			if err := json.Unmarshal(resp.Kvs[0].Value, quota); err != nil {
+				return fmt.Errorf("could not unmarshal quota: %w", err)
+			}
+		}
+		if err := fn(quota); err != nil {
+			return err
+		}
+		var op clientv3.Op
+		if quota.idle(limit) {
+			op = clientv3.OpDelete(key)
+		} else {
+			value, err := json.Marshal(quota)
+			if err != nil {
+				return fmt.Errorf("could not marshal quota: %w", err)
+			}
+			// The quota expires once it would be full again and all its runs
+			// expired, so inactive clients don't pile up.
+			lease, err := e.leaseID(ctx, quotaTTL(limit))
+			if err != nil {
+				return err
+			}
+			op = clientv3.OpPut(key, string(value), clientv3.WithLease(lease))
+		}
+		txnResp, err := e.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+			Then(op).
+			Commit()
+		if err != nil {
+			return fmt.Errorf("could not save quota: %w", err)
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+	}
+	return &errRateLimited{
+		reason:     "contention",
+		message:    "Too many concurrent runs!",
+		retryAfter: time.Second,
+	}
+}
+
+func quotaTTL(limit RateLimit) int64 {
+	ttl := RATE_LIMIT_RUN_EXPIRY.Seconds()
+	if limit.Rate > 0 {
+		ttl = math.Max(ttl, limit.Burst/limit.Rate)
+	}
+	return int64(math.Ceil(ttl))
+}
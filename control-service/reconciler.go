@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	RECONCILE_INTERVAL = 5 * time.Minute
+	// Unused worker queues get deleted by RabbitMQ after this duration, which
+	// covers queues whose pod vanished without a control-service noticing.
+	WORKER_QUEUE_EXPIRY = 10 * time.Minute
+
+	WORKER_OWNER_LABEL = "owner"
+	WORKER_ID_LABEL    = "worker-id"
+
+	DEFAULT_CONTROL_POD_SELECTOR = "io.kompose.service=control"
+	// CONTROL_INSTANCE_LABEL carries the instance ID on the control pods, it
+	// differs from the pod name if CONTROL_INSTANCE_ID is set.
+	CONTROL_INSTANCE_LABEL = "control-instance-id"
+)
+
+// determineInstanceID returns the id of this control-service instance which
+// is used to label the worker pods it owns. It defaults to the pod name.
+func determineInstanceID() (string, error) {
+	if instanceID := os.Getenv("CONTROL_INSTANCE_ID"); instanceID != "" {
+		return instanceID, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("could not determine hostname: %w", err)
+	}
+	return hostname, nil
+}
+
+// labelControlPod labels the pod of this instance with its ID, so the other
+// instances can tell which owners of worker pods are alive. The pod name is
+// the hostname.
+func (s *server) labelControlPod(ctx context.Context) error {
+	podName, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("could not determine hostname: %w", err)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{
+				CONTROL_INSTANCE_LABEL: s.instanceID,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal label patch: %w", err)
+	}
+	if _, err := s.kubernetes.clientSet.CoreV1().Pods(K8_NAMESPACE_NAME).Patch(ctx, podName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("could not label control pod %s with its instance id: %w", podName, err)
+	}
+	return nil
+}
+
+// liveInstances returns the ids of all running control-service instances.
+// They are read from the label of the control pods, the pods which didn't
+// label themselves yet can't own worker pods.
+func (s *server) liveInstances(ctx context.Context) (map[string]bool, error) {
+	selector := os.Getenv("CONTROL_POD_SELECTOR")
+	if selector == "" {
+		selector = DEFAULT_CONTROL_POD_SELECTOR
+	}
+	pods, err := s.kubernetes.clientSet.CoreV1().Pods(K8_NAMESPACE_NAME).List(ctx, metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list control pods: %w", err)
+	}
+	instances := map[string]bool{
+		s.instanceID: true,
+	}
+	for _, pod := range pods.Items {
+		instanceID := pod.Labels[CONTROL_INSTANCE_LABEL]
+		if instanceID != "" && pod.DeletionTimestamp == nil && pod.Status.Phase != v1.PodFailed && pod.Status.Phase != v1.PodSucceeded {
+			instances[instanceID] = true
+		}
+	}
+	return instances, nil
+}
+
+// reconcileWorkers adopts or deletes the worker pods whose control-service
+// instance is gone. Pods of this instance which no pool knows, e.g. the ones
+// which it created before its container restarted, get adopted or deleted as
+// well.
+func (s *server) reconcileWorkers(ctx context.Context) error {
+	pods, err := s.kubernetes.clientSet.CoreV1().Pods(K8_NAMESPACE_NAME).List(ctx, metav1.ListOptions{
+		LabelSelector: "role=worker",
+	})
+	if err != nil {
+		return fmt.Errorf("could not list worker pods: %w", err)
+	}
+	// The instances label their pod before they create workers, so listing
+	// them afterwards includes the owners of all listed worker pods.
+	instances, err := s.liveInstances(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		logger := log.WithField("pod", pod.Name)
+		owner := pod.Labels[WORKER_OWNER_LABEL]
+		workers, ok := s.workers[workertypes.WorkerLanguage(pod.Labels["language"])]
+		if owner == s.instanceID {
+			// Pods which are still starting are not registered yet
+			if ok && (workers.knowsPod(pod.Name) || time.Since(pod.CreationTimestamp.Time) <= POD_CACHE_GRACE_PERIOD) {
+				continue
+			}
+		} else if instances[owner] {
+			continue
+		}
+		if ok && workers.adopt(ctx, s.kubernetes, pod) {
+			logger.Printf("Adopted worker pod of instance %q", owner)
+			continue
+		}
+		logger.Printf("Deleting orphaned worker pod of instance %q", owner)
+		s.deleteOrphanedPod(ctx, pod)
+	}
+	return nil
+}
+
+func (s *server) deleteOrphanedPod(ctx context.Context, pod *v1.Pod) {
+	if err := s.kubernetes.clientSet.CoreV1().Pods(K8_NAMESPACE_NAME).Delete(ctx, pod.Name, metav1.DeleteOptions{
+		GracePeriodSeconds: ptr.To(int64(0)),
+	}); err != nil && !apierrors.IsNotFound(err) {
+		log.Printf("could not delete orphaned pod %s: %v", pod.Name, err)
+	}
+	workerID := pod.Labels[WORKER_ID_LABEL]
+	if workerID == "" {
+		return
+	}
+	// A failing queue operation closes the channel, so don't use the shared one
+	channel, err := s.amqpConnection.Channel()
+	if err != nil {
+		log.Printf("could not open channel: %v", err)
+		return
+	}
+	defer channel.Close()
+	if _, err := channel.QueueDelete(fmt.Sprintf("rpc_queue_%s", workerID), false, false, false); err != nil {
+		log.Printf("could not delete queue of orphaned worker %s: %v", workerID, err)
+	}
+}
+
+func (w *Workers) knowsPod(name string) bool {
+	_, ok := w.handles.Load(name)
+	return ok
+}
+
+// adopt takes over a healthy orphaned worker pod if the pool has room for it.
+// Updating the owner label fails if another instance adopted it meanwhile.
+func (w *Workers) adopt(ctx context.Context, kubernetes *kubernetesRuntime, pod *v1.Pod) bool {
+	workerID := pod.Labels[WORKER_ID_LABEL]
+	if workerID == "" || podHealth(pod) != workerHealthReady {
+		return false
+	}
+	// Pods of an outdated image would only get replaced right away
+	image := workerContainer(&pod.Spec).Image
+	if image != w.images.Image(w.language) {
+		return false
+	}
+	if w.warmCount()+int(w.starting.Load()) >= w.Target() {
+		return false
+	}
+	worker := &Worker{
+		id:        workerID,
+		workers:   w,
+		handle:    pod.Name,
+		image:     image,
+		language:  w.language,
+		createdAt: pod.CreationTimestamp.Time,
+	}
+	if worker.consumerHealth() != workerHealthReady {
+		return false
+	}
+	pod = pod.DeepCopy()
+	pod.Labels[WORKER_OWNER_LABEL] = kubernetes.owner
+	if _, err := kubernetes.clientSet.CoreV1().Pods(K8_NAMESPACE_NAME).Update(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		log.Printf("could not adopt pod %s: %v", pod.Name, err)
+		return false
+	}
+	w.register(worker)
+	if !w.put(worker) {
+		if err := worker.Cleanup(); err != nil {
+			log.Printf("could not cleanup surplus worker: %v", err)
+		}
+		return false
+	}
+	return true
+}
+
+func (s *server) runReconciler() {
+	ticker := time.NewTicker(RECONCILE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopReconciler:
+			return
+		case <-ticker.C:
+			if err := s.reconcileWorkers(context.Background()); err != nil {
+				log.Printf("could not reconcile workers: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+)
+
+// WorkerRuntime starts and stops the processes in which the workers run.
+type WorkerRuntime interface {
+	// Start launches the process of the worker and returns a handle which
+	// identifies it in the runtime (e.g. the pod name).
+	Start(ctx context.Context, worker *Worker) (string, error)
+	// Stop terminates the process of the worker, stopping an already stopped
+	// worker is no error.
+	Stop(ctx context.Context, worker *Worker) error
+	// Health reports the state of the worker process. It gets called while
+	// the pool is locked, so it must not block.
+	Health(worker *Worker) workerHealth
+	// Watch calls onChange with the handle of a worker of the language
+	// whenever its health might have changed, until stop is closed.
+	Watch(language workertypes.WorkerLanguage, stop <-chan struct{}, onChange func(handle string)) error
+}
+
+// newWorkerRuntime creates the runtime which is configured via the
+// WORKER_RUNTIME env var, Kubernetes is used by default.
+func newWorkerRuntime(owner string) (WorkerRuntime, error) {
+	switch kind := os.Getenv("WORKER_RUNTIME"); kind {
+	case "", "kubernetes":
+		return newKubernetesRuntime(owner)
+	case "local":
+		return newLocalRuntime(), nil
+	case "docker":
+		return newDockerRuntime(owner), nil
+	default:
+		return nil, fmt.Errorf("unknown worker runtime: %s", kind)
+	}
+}
+
+// workerEnv returns the env vars which every worker process needs. The
+// defaults match the service names inside the cluster.
+func workerEnv(worker *Worker) map[string]string {
+	env := map[string]string{
+		"WORKER_ID":         worker.id,
+		"WORKER_LANGUAGE":   string(worker.language),
+		"AMQP_URL":          getEnvDefault("WORKER_AMQP_URL", "amqp://rabbitmq:5672?heartbeat=5"),
+		"WORKER_HTTP_PROXY": getEnvDefault("WORKER_HTTP_PROXY", "http://squid:3128"),
+		"FILE_SERVICE_URL":  getEnvDefault("WORKER_FILE_SERVICE_URL", "http://file:8080"),
+	}
+	// The workers only export traces if the collector is reachable for them
+	if endpoint := os.Getenv("WORKER_OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		env["OTEL_EXPORTER_OTLP_ENDPOINT"] = endpoint
+		env["OTEL_SERVICE_NAME"] = fmt.Sprintf("worker-%s", worker.language)
+	}
+	// The workers log in the same way as the control-service
+	for _, key := range []string{"LOG_LEVEL", "LOG_FORMAT", "LOG_CODE", "LOG_CODE_MAX_LENGTH"} {
+		if value, ok := os.LookupEnv(key); ok {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+func getEnvDefault(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
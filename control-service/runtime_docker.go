@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_DOCKER_HOST  = "unix:///var/run/docker.sock"
+	DOCKER_POLL_INTERVAL = 2 * time.Second
+)
+
+// dockerRuntime runs the workers as containers via the Docker Engine API,
+// which Podman's socket implements as well.
+type dockerRuntime struct {
+	client *http.Client
+	owner  string
+
+	mu sync.Mutex
+	// containers caches the state of the worker containers by their language
+	// and id.
+	containers map[workertypes.WorkerLanguage]map[string]dockerContainerState
+}
+
+type dockerContainerState struct {
+	state string
+	// seenAt is when the state got recorded, entries which got recorded
+	// during a poll are not dropped by it.
+	seenAt time.Time
+}
+
+type dockerContainer struct {
+	ID    string `json:"Id"`
+	State string `json:"State"`
+}
+
+func newDockerRuntime(owner string) *dockerRuntime {
+	socketPath := strings.TrimPrefix(getEnvDefault("DOCKER_HOST", DEFAULT_DOCKER_HOST), "unix://")
+	return &dockerRuntime{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+			Timeout: 30 * time.Second,
+		},
+		owner:      owner,
+		containers: map[workertypes.WorkerLanguage]map[string]dockerContainerState{},
+	}
+}
+
+// do sends a request to the Docker API and decodes the response into result
+// if it is not nil.
+func (d *dockerRuntime) do(ctx context.Context, method, path string, body, result interface{}) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("could not marshal json: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	// The host is ignored since the connection goes to the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker"+path, reqBody)
+	if err != nil {
+		return 0, fmt.Errorf("could not create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("could not send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		message, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return resp.StatusCode, fmt.Errorf("could not decode response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *dockerRuntime) Start(ctx context.Context, worker *Worker) (string, error) {
+	env := []string{}
+	for name, value := range workerEnv(worker) {
+		env = append(env, fmt.Sprintf("%s=%s", name, value))
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if _, err := d.do(ctx, http.MethodPost, "/containers/create", map[string]interface{}{
+		"Image": worker.image,
+		"Env":   env,
+		"Labels": map[string]string{
+			"role":             "worker",
+			"language":         string(worker.language),
+			WORKER_OWNER_LABEL: d.owner,
+			WORKER_ID_LABEL:    worker.id,
+		},
+		"HostConfig": map[string]interface{}{
+			"Memory":      1024 * 1024 * 1024,
+			"NanoCpus":    1_000_000_000,
+			"NetworkMode": getEnvDefault("DOCKER_NETWORK", "default"),
+		},
+	}, &created); err != nil {
+		return "", fmt.Errorf("could not create container: %w", err)
+	}
+	d.setState(worker.language, created.ID, "created")
+	if _, err := d.do(ctx, http.MethodPost, fmt.Sprintf("/containers/%s/start", created.ID), nil, nil); err != nil {
+		// Don't leave the container behind, it would never be cleaned up
+		if err := d.remove(ctx, worker.language, created.ID); err != nil {
+			log.Printf("could not remove container which failed to start: %v", err)
+		}
+		return "", fmt.Errorf("could not start container: %w", err)
+	}
+	return created.ID, nil
+}
+
+func (d *dockerRuntime) setState(language workertypes.WorkerLanguage, id, state string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.containers[language] == nil {
+		d.containers[language] = map[string]dockerContainerState{}
+	}
+	d.containers[language][id] = dockerContainerState{state: state, seenAt: time.Now()}
+}
+
+func (d *dockerRuntime) Stop(ctx context.Context, worker *Worker) error {
+	return d.remove(ctx, worker.language, worker.handle)
+}
+
+// remove forgets the state of the container and removes it.
+func (d *dockerRuntime) remove(ctx context.Context, language workertypes.WorkerLanguage, id string) error {
+	d.mu.Lock()
+	delete(d.containers[language], id)
+	d.mu.Unlock()
+	status, err := d.do(ctx, http.MethodDelete, fmt.Sprintf("/containers/%s?force=true", id), nil, nil)
+	if err != nil && status != http.StatusNotFound {
+		return fmt.Errorf("could not remove container: %w", err)
+	}
+	return nil
+}
+
+func (d *dockerRuntime) Health(worker *Worker) workerHealth {
+	d.mu.Lock()
+	container, ok := d.containers[worker.language][worker.handle]
+	d.mu.Unlock()
+	if !ok {
+		return workerHealthDead
+	}
+	switch container.state {
+	case "running":
+		return workerHealthReady
+	case "created", "restarting":
+		return workerHealthStarting
+	default:
+		return workerHealthDead
+	}
+}
+
+// Watch polls the state of the worker containers of the language, since the
+// events endpoint is not implemented the same way by all engines.
+func (d *dockerRuntime) Watch(language workertypes.WorkerLanguage, stop <-chan struct{}, onChange func(handle string)) error {
+	if err := d.poll(language, onChange); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(DOCKER_POLL_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := d.poll(language, onChange); err != nil {
+					log.Printf("could not poll %s worker containers: %v", language, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (d *dockerRuntime) poll(language workertypes.WorkerLanguage, onChange func(handle string)) error {
+	filters, err := json.Marshal(map[string][]string{
+		"label": {
+			"role=worker",
+			fmt.Sprintf("language=%s", language),
+			fmt.Sprintf("%s=%s", WORKER_OWNER_LABEL, d.owner),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal filters: %w", err)
+	}
+	pollStart := time.Now()
+	var containers []dockerContainer
+	if _, err := d.do(context.Background(), http.MethodGet, "/containers/json?all=true&filters="+url.QueryEscape(string(filters)), nil, &containers); err != nil {
+		return fmt.Errorf("could not list containers: %w", err)
+	}
+	listed := map[string]string{}
+	for _, container := range containers {
+		listed[container.ID] = container.State
+	}
+	changed := []string{}
+	d.mu.Lock()
+	known := d.containers[language]
+	if known == nil {
+		known = map[string]dockerContainerState{}
+		d.containers[language] = known
+	}
+	for id, state := range listed {
+		if previous, ok := known[id]; !ok || previous.state != state {
+			changed = append(changed, id)
+		}
+		known[id] = dockerContainerState{state: state, seenAt: pollStart}
+	}
+	for id, container := range known {
+		// Containers which got created during the poll might be missing
+		if _, ok := listed[id]; ok || container.seenAt.After(pollStart) {
+			continue
+		}
+		delete(known, id)
+		changed = append(changed, id)
+	}
+	d.mu.Unlock()
+	for _, id := range changed {
+		onChange(id)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
+)
+
+// POD_CACHE_GRACE_PERIOD is how long a freshly created pod might be missing
+// in the informer cache before it is considered gone.
+const POD_CACHE_GRACE_PERIOD = 30 * time.Second
+
+// Container waiting reasons from which a worker won't recover on its own.
+var deadContainerReasons = []string{
+	"ErrImagePull",
+	"ImagePullBackOff",
+	"InvalidImageName",
+	"CrashLoopBackOff",
+	"CreateContainerConfigError",
+	"CreateContainerError",
+}
+
+type kubernetesRuntime struct {
+	clientSet kubernetes.Interface
+	owner     string
+	templates map[workertypes.WorkerLanguage]*v1.PodTemplateSpec
+
+	listersMu sync.RWMutex
+	listers   map[workertypes.WorkerLanguage]corelisters.PodLister
+}
+
+func newKubernetesRuntime(owner string) (*kubernetesRuntime, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("could not create k8 in cluster config: %w", err)
+	}
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create k8 clientset: %w", err)
+	}
+	templates, err := loadPodTemplates(os.Getenv("WORKER_POD_TEMPLATE"))
+	if err != nil {
+		return nil, err
+	}
+	return &kubernetesRuntime{
+		clientSet: clientSet,
+		owner:     owner,
+		templates: templates,
+		listers:   map[workertypes.WorkerLanguage]corelisters.PodLister{},
+	}, nil
+}
+
+func (k *kubernetesRuntime) Start(ctx context.Context, worker *Worker) (string, error) {
+	pod := buildPod(k.templates[worker.language], worker, map[string]string{
+		"role":             "worker",
+		"language":         string(worker.language),
+		WORKER_OWNER_LABEL: k.owner,
+		WORKER_ID_LABEL:    worker.id,
+	})
+	pod, err := k.clientSet.CoreV1().Pods(K8_NAMESPACE_NAME).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not create pod: %w", err)
+	}
+	return pod.Name, nil
+}
+
+func (k *kubernetesRuntime) Stop(ctx context.Context, worker *Worker) error {
+	if err := k.clientSet.CoreV1().Pods(K8_NAMESPACE_NAME).
+		Delete(ctx, worker.handle, metav1.DeleteOptions{
+			GracePeriodSeconds: ptr.To(int64(0)),
+		}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete pod: %w", err)
+	}
+	return nil
+}
+
+func (k *kubernetesRuntime) Health(worker *Worker) workerHealth {
+	k.listersMu.RLock()
+	lister, ok := k.listers[worker.language]
+	k.listersMu.RUnlock()
+	if !ok {
+		return workerHealthStarting
+	}
+	pod, err := lister.Pods(K8_NAMESPACE_NAME).Get(worker.handle)
+	if apierrors.IsNotFound(err) {
+		if time.Since(worker.createdAt) < POD_CACHE_GRACE_PERIOD {
+			return workerHealthStarting
+		}
+		return workerHealthDead
+	}
+	if err != nil {
+		log.Printf("could not get pod %s from cache: %v", worker.handle, err)
+		return workerHealthStarting
+	}
+	return podHealth(pod)
+}
+
+func podHealth(pod *v1.Pod) workerHealth {
+	if pod.DeletionTimestamp != nil {
+		return workerHealthDead
+	}
+	switch pod.Status.Phase {
+	case v1.PodFailed, v1.PodSucceeded:
+		// Evicted and OOM killed pods end up here as well
+		return workerHealthDead
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated != nil {
+			return workerHealthDead
+		}
+		if status.State.Waiting != nil && slices.Contains(deadContainerReasons, status.State.Waiting.Reason) {
+			return workerHealthDead
+		}
+	}
+	if pod.Status.Phase == v1.PodRunning {
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+				return workerHealthReady
+			}
+		}
+	}
+	return workerHealthStarting
+}
+
+// Watch keeps a cache of the worker pods of the language up to date via an
+// informer.
+func (k *kubernetesRuntime) Watch(language workertypes.WorkerLanguage, stop <-chan struct{}, onChange func(handle string)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.clientSet, 0,
+		informers.WithNamespace(K8_NAMESPACE_NAME),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = fmt.Sprintf("role=worker,language=%s", language)
+		}),
+	)
+	podInformer := factory.Core().V1().Pods()
+	onPodEvent := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if pod, ok := obj.(*v1.Pod); ok {
+			onChange(pod.Name)
+		}
+	}
+	if _, err := podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: onPodEvent,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			onPodEvent(newObj)
+		},
+		DeleteFunc: onPodEvent,
+	}); err != nil {
+		return fmt.Errorf("could not add pod event handler: %w", err)
+	}
+	k.listersMu.Lock()
+	k.listers[language] = podInformer.Lister()
+	k.listersMu.Unlock()
+	factory.Start(stop)
+	for informerType, synced := range factory.WaitForCacheSync(stop) {
+		if !synced {
+			return fmt.Errorf("could not sync %v informer", informerType)
+		}
+	}
+	return nil
+}
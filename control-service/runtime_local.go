@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	log "github.com/sirupsen/logrus"
+)
+
+// localRuntime runs the workers as child processes of the control-service,
+// which is meant for local development without a cluster.
+type localRuntime struct {
+	mu        sync.Mutex
+	processes map[string]*localProcess
+	onChange  map[workertypes.WorkerLanguage]func(handle string)
+}
+
+type localProcess struct {
+	cmd    *exec.Cmd
+	tmpDir string
+	exited chan struct{}
+}
+
+func newLocalRuntime() *localRuntime {
+	return &localRuntime{
+		processes: map[string]*localProcess{},
+		onChange:  map[workertypes.WorkerLanguage]func(handle string){},
+	}
+}
+
+// determineWorkerBinary returns the worker executable of the language, which
+// is taken from the PATH unless WORKER_BINARY_<LANGUAGE> is set.
+func determineWorkerBinary(language workertypes.WorkerLanguage) string {
+	return getEnvDefault(fmt.Sprintf("WORKER_BINARY_%s", strings.ToUpper(string(language))), fmt.Sprintf("worker-%s", language))
+}
+
+func (l *localRuntime) Start(ctx context.Context, worker *Worker) (string, error) {
+	tmpDir, err := os.MkdirTemp("", fmt.Sprintf("worker-%s-", worker.language))
+	if err != nil {
+		return "", fmt.Errorf("could not create tmp dir: %w", err)
+	}
+	cmd := exec.Command(determineWorkerBinary(worker.language))
+	cmd.Env = os.Environ()
+	for name, value := range workerEnv(worker) {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", name, value))
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("TMPDIR=%s", tmpDir))
+	cmd.Dir = tmpDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// The worker spawns the browsers, so they have to be killed together
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", fmt.Errorf("could not start worker process: %w", err)
+	}
+	process := &localProcess{
+		cmd:    cmd,
+		tmpDir: tmpDir,
+		exited: make(chan struct{}),
+	}
+	handle := worker.id
+	l.mu.Lock()
+	l.processes[handle] = process
+	onChange := l.onChange[worker.language]
+	l.mu.Unlock()
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.WithField("worker-id", worker.id).Printf("Worker process exited: %v", err)
+		}
+		close(process.exited)
+		if onChange != nil {
+			onChange(handle)
+		}
+	}()
+	return handle, nil
+}
+
+func (l *localRuntime) Stop(ctx context.Context, worker *Worker) error {
+	l.mu.Lock()
+	process, ok := l.processes[worker.handle]
+	delete(l.processes, worker.handle)
+	l.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-process.exited:
+	default:
+		if err := syscall.Kill(-process.cmd.Process.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("could not kill worker process: %w", err)
+		}
+		<-process.exited
+	}
+	if err := os.RemoveAll(process.tmpDir); err != nil {
+		return fmt.Errorf("could not remove tmp dir: %w", err)
+	}
+	return nil
+}
+
+func (l *localRuntime) Health(worker *Worker) workerHealth {
+	l.mu.Lock()
+	process, ok := l.processes[worker.handle]
+	l.mu.Unlock()
+	if !ok {
+		return workerHealthDead
+	}
+	select {
+	case <-process.exited:
+		return workerHealthDead
+	default:
+		// Whether it is consuming its queue gets checked separately
+		return workerHealthReady
+	}
+}
+
+func (l *localRuntime) Watch(language workertypes.WorkerLanguage, stop <-chan struct{}, onChange func(handle string)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onChange[language] = onChange
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+// WORKER_RUN_AS_USER is the uid of pwuser in the Playwright images. It has
+// to be numeric, otherwise the kubelet can't verify runAsNonRoot.
+const WORKER_RUN_AS_USER = 1001
+
+// workerSecurityProfile contains the exceptions from the locked down security
+// context which the workers of a language need.
+type workerSecurityProfile struct {
+	// writableRootFilesystem is needed by the languages whose execution
+	// directory is prepared in the image and whose build tools write into
+	// the home directory.
+	writableRootFilesystem bool
+	// writableDirectories get an emptyDir mounted, so they stay writable
+	// with a read-only root filesystem.
+	writableDirectories []string
+}
+
+var workerSecurityProfiles = map[workertypes.WorkerLanguage]workerSecurityProfile{
+	// The execution directory is created inside of /tmp
+	workertypes.WorkerLanguageJavaScript: {
+		writableDirectories: []string{"/tmp"},
+	},
+	workertypes.WorkerLanguagePython: {
+		writableDirectories: []string{"/tmp"},
+	},
+	// Maven and dotnet write into the prebuilt /home/pwuser/project and their
+	// caches in the home directory.
+	workertypes.WorkerLanguageJava: {
+		writableRootFilesystem: true,
+		writableDirectories:    []string{"/tmp"},
+	},
+	workertypes.WorkerLanguageCSharp: {
+		writableRootFilesystem: true,
+		writableDirectories:    []string{"/tmp"},
+	},
+}
+
+// applySecurityDefaults locks down the worker pod since it runs user submitted
+// code. Only the fields which the pod template does not set get defaulted,
+// so operators can loosen them per language.
+func applySecurityDefaults(pod *v1.Pod, container *v1.Container, language workertypes.WorkerLanguage) {
+	profile := workerSecurityProfiles[language]
+
+	if pod.Spec.SecurityContext == nil {
+		pod.Spec.SecurityContext = &v1.PodSecurityContext{}
+	}
+	podContext := pod.Spec.SecurityContext
+	if podContext.RunAsNonRoot == nil {
+		podContext.RunAsNonRoot = ptr.To(true)
+	}
+	if podContext.RunAsUser == nil {
+		podContext.RunAsUser = ptr.To(int64(WORKER_RUN_AS_USER))
+	}
+	if podContext.SeccompProfile == nil {
+		podContext.SeccompProfile = &v1.SeccompProfile{Type: v1.SeccompProfileTypeRuntimeDefault}
+	}
+
+	if container.SecurityContext == nil {
+		container.SecurityContext = &v1.SecurityContext{}
+	}
+	containerContext := container.SecurityContext
+	if containerContext.AllowPrivilegeEscalation == nil {
+		containerContext.AllowPrivilegeEscalation = ptr.To(false)
+	}
+	if containerContext.Privileged == nil {
+		containerContext.Privileged = ptr.To(false)
+	}
+	if containerContext.Capabilities == nil {
+		containerContext.Capabilities = &v1.Capabilities{Drop: []v1.Capability{"ALL"}}
+	}
+	if containerContext.ReadOnlyRootFilesystem == nil {
+		containerContext.ReadOnlyRootFilesystem = ptr.To(!profile.writableRootFilesystem)
+	}
+
+	for _, path := range profile.writableDirectories {
+		if slices.ContainsFunc(container.VolumeMounts, func(mount v1.VolumeMount) bool {
+			return mount.MountPath == path
+		}) {
+			continue
+		}
+		name := "writable" + strings.ReplaceAll(path, "/", "-")
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+			Name: name,
+			VolumeSource: v1.VolumeSource{
+				EmptyDir: &v1.EmptyDirVolumeSource{},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{
+			Name:      name,
+			MountPath: path,
+		})
+	}
+}
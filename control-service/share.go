@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	SHARE_SCHEMA_VERSION   = 1
+	SHARE_MAX_BODY_SIZE    = 1 << 20
+	SHARE_MAX_TITLE_SIZE   = 200
+	SHARE_MAX_VERSION_SIZE = 64
+	SHARE_MAX_TTL          = 365 * 24 * 60 * 60
+)
+
+// ShareDocument is the persisted representation of a shared snippet.
+type ShareDocument struct {
+	SchemaVersion     int                        `json:"schemaVersion"`
+	ID                string                     `json:"id"`
+	Code              string                     `json:"code"`
+	Language          workertypes.WorkerLanguage `json:"language,omitempty"`
+	PlaywrightVersion string                     `json:"playwrightVersion,omitempty"`
+	Title             string                     `json:"title,omitempty"`
+	CreatedAt         time.Time                  `json:"createdAt"`
+	// ParentID is the id of the share which this share got forked from.
+	ParentID  string     `json:"parentId,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// DeleteTokenHash is the SHA-256 hash of the token which is required to
+	// delete the share, it never gets returned to the user.
+	DeleteTokenHash string `json:"deleteTokenHash,omitempty"`
+}
+
+func (d *ShareDocument) IsExpired() bool {
+	return d.ExpiresAt != nil && time.Now().After(*d.ExpiresAt)
+}
+
+// shareCreateRequest contains the fields of a ShareDocument which can be set
+// by the user.
+type shareCreateRequest struct {
+	Code              string                     `json:"code"`
+	Language          workertypes.WorkerLanguage `json:"language"`
+	PlaywrightVersion string                     `json:"playwrightVersion"`
+	Title             string                     `json:"title"`
+	ParentID          string                     `json:"parentId"`
+	// TTL is the lifetime of the share in seconds, zero means forever.
+	TTL int64 `json:"ttl"`
+}
+
+func (r *shareCreateRequest) Validate() error {
+	if strings.TrimSpace(r.Code) == "" {
+		return errors.New("code is required")
+	}
+	if !r.Language.IsValid() {
+		return errors.New("could not recognize language")
+	}
+	if len(r.Title) > SHARE_MAX_TITLE_SIZE {
+		return fmt.Errorf("title is longer than %d characters", SHARE_MAX_TITLE_SIZE)
+	}
+	if len(r.PlaywrightVersion) > SHARE_MAX_VERSION_SIZE {
+		return errors.New("invalid Playwright version")
+	}
+	if r.ParentID != "" && !shareIDRegexp.MatchString(r.ParentID) {
+		return errors.New("invalid parent share id")
+	}
+	if r.TTL < 0 || r.TTL > SHARE_MAX_TTL {
+		return fmt.Errorf("ttl must be between 0 and %d seconds", SHARE_MAX_TTL)
+	}
+	return nil
+}
+
+func hashDeleteToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// getShare returns the share and removes it if it is expired, since not all
+// stores support expiring keys natively.
+func (s *server) getShare(ctx context.Context, id string) (*ShareDocument, error) {
+	value, err := s.shareStore.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	doc := decodeShareDocument(id, value)
+	if doc.IsExpired() {
+		if err := s.shareStore.Delete(ctx, id); err != nil && !errors.Is(err, errShareNotFound) {
+			return nil, fmt.Errorf("could not delete expired share: %w", err)
+		}
+		return nil, errShareNotFound
+	}
+	return doc, nil
+}
+
+// decodeShareDocument decodes a stored share and upcasts older schemas to the
+// current one. Before the schema got introduced, shares were stored as the
+// raw code.
+func decodeShareDocument(id string, value []byte) *ShareDocument {
+	var doc *ShareDocument
+	if err := json.Unmarshal(value, &doc); err != nil || doc == nil || doc.SchemaVersion == 0 {
+		doc = &ShareDocument{
+			Code: string(value),
+		}
+	}
+	doc.SchemaVersion = SHARE_SCHEMA_VERSION
+	doc.ID = id
+	return doc
+}
+
+func (s *server) handleShareGet(c echo.Context) error {
+	doc, err := s.getShare(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, errShareNotFound) {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "no share found",
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("could not fetch share: %w", err)
+	}
+	doc.DeleteTokenHash = ""
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("could not marshal share: %w", err)
+	}
+	hash := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(hash[:]))
+	c.Response().Header().Set("ETag", etag)
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, body)
+}
+
+func (s *server) handleShareCreate(c echo.Context) error {
+	ctx := c.Request().Context()
+	var req *shareCreateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(c.Response().Writer, c.Request().Body, SHARE_MAX_BODY_SIZE)).Decode(&req); err != nil || req == nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "could not decode request body",
+		})
+	}
+	if err := req.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": err.Error(),
+		})
+	}
+	if req.ParentID != "" {
+		if _, err := s.getShare(ctx, req.ParentID); err != nil {
+			if errors.Is(err, errShareNotFound) {
+				return c.JSON(http.StatusBadRequest, echo.Map{
+					"error": "parent share does not exist",
+				})
+			}
+			return fmt.Errorf("could not fetch parent share: %w", err)
+		}
+	}
+	deleteToken, err := generateDeleteToken()
+	if err != nil {
+		return err
+	}
+	doc := &ShareDocument{
+		SchemaVersion:     SHARE_SCHEMA_VERSION,
+		Code:              req.Code,
+		Language:          req.Language,
+		PlaywrightVersion: req.PlaywrightVersion,
+		Title:             req.Title,
+		CreatedAt:         time.Now().UTC(),
+		ParentID:          req.ParentID,
+		DeleteTokenHash:   hashDeleteToken(deleteToken),
+	}
+	ttl := time.Duration(req.TTL) * time.Second
+	if ttl > 0 {
+		doc.ExpiresAt = ptr.To(doc.CreatedAt.Add(ttl))
+	}
+	for retryCount := 0; retryCount <= 3; retryCount++ {
+		doc.ID = generateRandomString(SNIPPET_ID_LENGTH)
+		value, err := json.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("could not marshal share: %w", err)
+		}
+		err = s.shareStore.Create(ctx, doc.ID, value, ttl)
+		if errors.Is(err, errShareExists) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not save share: %w", err)
+		}
+		return c.JSON(http.StatusCreated, echo.Map{
+			"key":         doc.ID,
+			"deleteToken": deleteToken,
+			"expiresAt":   doc.ExpiresAt,
+		})
+	}
+	return errors.New("could not generate a key")
+}
+
+func generateDeleteToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf("could not generate delete token: %w", err)
+	}
+	return hex.EncodeToString(token), nil
+}
+
+func (s *server) handleShareDelete(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	doc, err := s.getShare(ctx, id)
+	if errors.Is(err, errShareNotFound) {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "no share found",
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("could not fetch share: %w", err)
+	}
+	token := c.Request().Header.Get("X-Delete-Token")
+	// Shares which were created before delete tokens existed can't be deleted
+	if doc.DeleteTokenHash == "" || token == "" ||
+		subtle.ConstantTimeCompare([]byte(hashDeleteToken(token)), []byte(doc.DeleteTokenHash)) != 1 {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "invalid delete token",
+		})
+	}
+	if err := s.shareStore.Delete(ctx, id); err != nil && !errors.Is(err, errShareNotFound) {
+		return fmt.Errorf("could not delete share: %w", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mxschmitt/try-playwright/internal/minioutils"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	errShareNotFound = errors.New("no share found")
+	errShareExists   = errors.New("share already exists")
+)
+
+var shareIDRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// ShareStore persists the shared snippets.
+type ShareStore interface {
+	// Get returns errShareNotFound if no share with the given id exists.
+	Get(ctx context.Context, id string) ([]byte, error)
+	// Create returns errShareExists if a share with the given id exists already.
+	// Stores which support expiring keys natively remove the share after ttl,
+	// a ttl of zero means that the share never expires.
+	Create(ctx context.Context, id string, value []byte, ttl time.Duration) error
+	// Delete returns errShareNotFound if no share with the given id exists.
+	Delete(ctx context.Context, id string) error
+}
+
+// newShareStore creates the share store which is configured via the
+// SHARE_STORE env var, etcd is used by default.
+func newShareStore(etcdClient *clientv3.Client) (ShareStore, error) {
+	switch kind := os.Getenv("SHARE_STORE"); kind {
+	case "", "etcd":
+		if etcdClient == nil {
+			return nil, errors.New("etcd share store requires 'ETCD_ENDPOINT' env var")
+		}
+		return &etcdShareStore{client: etcdClient}, nil
+	case "s3":
+		minioClient, err := minioutils.NewClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		bucketName := os.Getenv("SHARE_STORE_BUCKET")
+		if bucketName == "" {
+			bucketName = DEFAULT_SHARE_BUCKET_NAME
+		}
+		if err := minioutils.EnsureBucket(context.Background(), minioClient, bucketName, nil); err != nil {
+			return nil, err
+		}
+		return &s3ShareStore{client: minioClient, bucketName: bucketName}, nil
+	case "filesystem":
+		return newFilesystemShareStore(os.Getenv("SHARE_STORE_PATH"))
+	case "memory":
+		return newMemoryShareStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown share store: %s", kind)
+	}
+}
+
+type memoryShareStore struct {
+	mu     sync.Mutex
+	shares map[string][]byte
+}
+
+func newMemoryShareStore() *memoryShareStore {
+	return &memoryShareStore{
+		shares: map[string][]byte{},
+	}
+}
+
+func (m *memoryShareStore) Get(ctx context.Context, id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.shares[id]
+	if !ok {
+		return nil, errShareNotFound
+	}
+	return value, nil
+}
+
+func (m *memoryShareStore) Create(ctx context.Context, id string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.shares[id]; ok {
+		return errShareExists
+	}
+	m.shares[id] = value
+	return nil
+}
+
+func (m *memoryShareStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.shares[id]; !ok {
+		return errShareNotFound
+	}
+	delete(m.shares, id)
+	return nil
+}
+
+type filesystemShareStore struct {
+	dir string
+}
+
+func newFilesystemShareStore(dir string) (*filesystemShareStore, error) {
+	if dir == "" {
+		return nil, errors.New("filesystem share store requires 'SHARE_STORE_PATH' env var")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create share directory: %w", err)
+	}
+	return &filesystemShareStore{dir: dir}, nil
+}
+
+func (f *filesystemShareStore) path(id string) (string, error) {
+	// Share ids are user input, never let them escape the share directory
+	if !shareIDRegexp.MatchString(id) {
+		return "", errShareNotFound
+	}
+	return filepath.Join(f.dir, id), nil
+}
+
+func (f *filesystemShareStore) Get(ctx context.Context, id string) ([]byte, error) {
+	path, err := f.path(id)
+	if err != nil {
+		return nil, err
+	}
+	value, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errShareNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read share: %w", err)
+	}
+	return value, nil
+}
+
+// Create writes the share to a temporary file first, so failed writes never
+// leave a truncated share behind. Linking it into place fails if the id is
+// taken already, unlike renaming.
+func (f *filesystemShareStore) Create(ctx context.Context, id string, value []byte, ttl time.Duration) error {
+	path, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(f.dir, "."+id+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not create share: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(value); err != nil {
+		file.Close()
+		return fmt.Errorf("could not write share: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("could not write share: %w", err)
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return fmt.Errorf("could not write share: %w", err)
+	}
+	err = os.Link(file.Name(), path)
+	if errors.Is(err, os.ErrExist) {
+		return errShareExists
+	}
+	if err != nil {
+		return fmt.Errorf("could not create share: %w", err)
+	}
+	return nil
+}
+
+func (f *filesystemShareStore) Delete(ctx context.Context, id string) error {
+	path, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return errShareNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("could not delete share: %w", err)
+	}
+	return nil
+}
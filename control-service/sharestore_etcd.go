@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type etcdShareStore struct {
+	client *clientv3.Client
+}
+
+func (e *etcdShareStore) Get(ctx context.Context, id string) ([]byte, error) {
+	resp, err := e.client.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch share: %w", err)
+	}
+	if resp.Count == 0 {
+		return nil, errShareNotFound
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (e *etcdShareStore) Create(ctx context.Context, id string, value []byte, ttl time.Duration) error {
+	var opts []clientv3.OpOption
+	if ttl > 0 {
+		lease, err := e.client.Grant(ctx, int64(ttl.Seconds()))
+		if err != nil {
+			return fmt.Errorf("could not grant lease: %w", err)
+		}
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(id), "=", 0)).
+		Then(clientv3.OpPut(id, string(value), opts...)).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("could not save share: %w", err)
+	}
+	if !resp.Succeeded {
+		return errShareExists
+	}
+	return nil
+}
+
+func (e *etcdShareStore) Delete(ctx context.Context, id string) error {
+	resp, err := e.client.Delete(ctx, id)
+	if err != nil {
+		return fmt.Errorf("could not delete share: %w", err)
+	}
+	if resp.Deleted == 0 {
+		return errShareNotFound
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const DEFAULT_SHARE_BUCKET_NAME = "shares"
+
+type s3ShareStore struct {
+	client     *minio.Client
+	bucketName string
+}
+
+func (s *s3ShareStore) Get(ctx context.Context, id string) ([]byte, error) {
+	object, err := s.client.GetObject(ctx, s.bucketName, id, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get share object: %w", err)
+	}
+	defer object.Close()
+	value, err := io.ReadAll(object)
+	if err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return nil, errShareNotFound
+		}
+		return nil, fmt.Errorf("could not read share object: %w", err)
+	}
+	return value, nil
+}
+
+func (s *s3ShareStore) Create(ctx context.Context, id string, value []byte, ttl time.Duration) error {
+	opts := minio.PutObjectOptions{}
+	// Only create the object if it does not exist yet
+	opts.SetMatchETagExcept("*")
+	if _, err := s.client.PutObject(ctx, s.bucketName, id, bytes.NewReader(value), int64(len(value)), opts); err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusPreconditionFailed {
+			return errShareExists
+		}
+		return fmt.Errorf("could not put share object: %w", err)
+	}
+	return nil
+}
+
+func (s *s3ShareStore) Delete(ctx context.Context, id string) error {
+	if _, err := s.client.StatObject(ctx, s.bucketName, id, minio.StatObjectOptions{}); err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return errShareNotFound
+		}
+		return fmt.Errorf("could not stat share object: %w", err)
+	}
+	if err := s.client.RemoveObject(ctx, s.bucketName, id, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("could not remove share object: %w", err)
+	}
+	return nil
+}
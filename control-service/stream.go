@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+)
+
+// Server-Sent Events which are emitted by the run stream endpoint.
+const (
+	streamEventQueued = "queued"
+	streamEventOutput = "output"
+	streamEventResult = "result"
+	streamEventError  = "error"
+)
+
+func writeStreamEvent(c echo.Context, event string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("could not marshal event data: %w", err)
+	}
+	if _, err := fmt.Fprintf(c.Response(), "event: %s\ndata: %s\n\n", event, body); err != nil {
+		return fmt.Errorf("could not write event: %w", err)
+	}
+	c.Response().Flush()
+	return nil
+}
+
+func (s *server) handleRunStream(c echo.Context) error {
+	req, err := s.parseRunRequest(c)
+	if err != nil {
+		s.auditRun(c.Request().Context(), req, s.clientID(c), nil, err)
+		return jsonError(c, err)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+	c.Response().Header().Set(echo.HeaderConnection, "keep-alive")
+	// Disable response buffering of reverse proxies like nginx
+	c.Response().Header().Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+
+	logger := logging.FromContext(c.Request().Context())
+	payload, err := s.executeRun(c.Request().Context(), req, runOptions{
+		client: s.clientID(c),
+		onQueued: func(position int) {
+			if err := writeStreamEvent(c, streamEventQueued, echo.Map{
+				"position": position,
+			}); err != nil {
+				logger.Printf("could not write queue position: %v", err)
+			}
+		},
+		onOutput: func(chunk *workertypes.WorkerOutputChunk) {
+			if err := writeStreamEvent(c, streamEventOutput, chunk); err != nil {
+				logger.Printf("could not write output chunk: %v", err)
+			}
+		},
+	})
+	if err != nil {
+		var httpErr *echo.HTTPError
+		if !errors.As(err, &httpErr) {
+			logger.Printf("could not execute run: %v", err)
+			httpErr = echo.NewHTTPError(http.StatusInternalServerError, "Execution was not successful!")
+		}
+		return writeStreamEvent(c, streamEventError, echo.Map{
+			"error": httpErr.Message,
+		})
+	}
+	return writeStreamEvent(c, streamEventResult, payload)
+}
@@ -3,65 +3,246 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_TURNSTILE_SITEVERIFY_URL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	// TURNSTILE_RESULT_TTL is how long the result of a token is remembered,
+	// Turnstile tokens are valid for 300 seconds.
+	TURNSTILE_RESULT_TTL = 5 * time.Minute
+	// TURNSTILE_RESULT_CACHE_SIZE caps the remembered results.
+	TURNSTILE_RESULT_CACHE_SIZE = 10000
 )
 
+var (
+	// errCaptchaRejected is returned if the token of the user is invalid.
+	errCaptchaRejected = errors.New("turnstile validation failed")
+	// errCaptchaUnavailable is returned if the token could not be checked,
+	// e.g. because the verifier is down or misconfigured.
+	errCaptchaUnavailable = errors.New("could not verify turnstile token")
+)
+
+// CaptchaVerifier checks the captcha token which the frontend sends along
+// with the runs.
+type CaptchaVerifier interface {
+	// Verify returns an error wrapping errCaptchaRejected or
+	// errCaptchaUnavailable if the token can't be accepted.
+	Verify(ctx context.Context, token string, remoteIP string) error
+}
+
+// newCaptchaVerifier creates the verifier which is configured via the
+// CAPTCHA_VERIFIER env var. It defaults to Turnstile if a secret key is set.
+func newCaptchaVerifier() (CaptchaVerifier, error) {
+	kind := os.Getenv("CAPTCHA_VERIFIER")
+	secretKey := os.Getenv("TURNSTILE_SECRET_KEY")
+	if kind == "" {
+		kind = "turnstile"
+		if secretKey == "" {
+			log.Printf("warning: Turnstile secretKey is empty, skipping validation")
+			kind = "noop"
+		}
+	}
+	switch kind {
+	case "turnstile":
+		if secretKey == "" {
+			return nil, errors.New("turnstile verifier requires 'TURNSTILE_SECRET_KEY' env var")
+		}
+		verifier := &turnstileVerifier{
+			client:        &http.Client{Timeout: 15 * time.Second},
+			secretKey:     secretKey,
+			siteverifyURL: os.Getenv("TURNSTILE_SITEVERIFY_URL"),
+			action:        os.Getenv("TURNSTILE_ACTION"),
+			cdata:         os.Getenv("TURNSTILE_CDATA"),
+		}
+		if verifier.siteverifyURL == "" {
+			verifier.siteverifyURL = DEFAULT_TURNSTILE_SITEVERIFY_URL
+		}
+		if hostnames := os.Getenv("TURNSTILE_HOSTNAMES"); hostnames != "" {
+			verifier.hostnames = strings.Split(hostnames, ",")
+		}
+		return verifier, nil
+	case "noop":
+		return noopCaptchaVerifier{}, nil
+	default:
+		return nil, fmt.Errorf("unknown captcha verifier: %s", kind)
+	}
+}
+
+// noopCaptchaVerifier accepts all tokens, it is meant for development.
+type noopCaptchaVerifier struct{}
+
+func (noopCaptchaVerifier) Verify(ctx context.Context, token string, remoteIP string) error {
+	return nil
+}
+
+// turnstileVerifier checks the tokens via the Cloudflare Turnstile siteverify
+// API. The action, hostname and cdata of the challenge only get checked if
+// they are configured.
+type turnstileVerifier struct {
+	client        *http.Client
+	secretKey     string
+	siteverifyURL string
+	action        string
+	hostnames     []string
+	cdata         string
+
+	// results remembers the outcome of the tokens by their hash until they
+	// expire. Tokens are single-use, so a replayed token gets rejected
+	// without asking siteverify again.
+	resultsMu sync.Mutex
+	results   map[[sha256.Size]byte]turnstileResult
+}
+
+type turnstileResult struct {
+	err       error
+	expiresAt time.Time
+}
+
 type TurnstileResponse struct {
-    Success    bool     `json:"success"`
-    ErrorCodes []string `json:"error-codes,omitempty"`
+	Success     bool     `json:"success"`
+	ErrorCodes  []string `json:"error-codes,omitempty"`
+	ChallengeTS string   `json:"challenge_ts,omitempty"`
+	Hostname    string   `json:"hostname,omitempty"`
+	Action      string   `json:"action,omitempty"`
+	CData       string   `json:"cdata,omitempty"`
 }
 
-var turnStileHttpClient = &http.Client{Timeout: 15 * time.Second}
+// Error codes which are caused by the configuration and not by the user.
+var turnstileConfigErrorCodes = []string{
+	"missing-input-secret",
+	"invalid-input-secret",
+	"bad-request",
+	"internal-error",
+}
 
-func ValidateTurnstile(ctx context.Context, token string, remoteIP string, secretKey string) error {
-	if secretKey == "" {
-		log.Printf("warning: Turnstile secretKey is empty, skipping validation")
-		return nil
+func (t *turnstileVerifier) Verify(ctx context.Context, token string, remoteIP string) error {
+	if token == "" {
+		return fmt.Errorf("%w: no token provided", errCaptchaRejected)
+	}
+	key := sha256.Sum256([]byte(token))
+	if cached := t.cachedResult(key); cached != nil {
+		return cached.err
+	}
+	request := map[string]string{
+		"secret":   t.secretKey,
+		"response": token,
+		// Allows retrying the request without the token counting as used
+		"idempotency_key": uuid.New().String(),
+	}
+	if remoteIP != "" {
+		request["remoteip"] = remoteIP
+	}
+	result, err := t.siteverify(ctx, request)
+	if err != nil {
+		log.Printf("Retrying Turnstile validation: %v", err)
+		result, err = t.siteverify(ctx, request)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCaptchaUnavailable, err)
+	}
+	err = t.check(result)
+	if !errors.Is(err, errCaptchaUnavailable) {
+		t.cacheResult(key, err)
 	}
-	if remoteIP == "" {
-		log.Printf("warning: Turnstile remoteIP is empty, skipping validation")
+	return err
+}
+
+// check returns whether the siteverify result accepts the token.
+func (t *turnstileVerifier) check(result *TurnstileResponse) error {
+	if !result.Success {
+		for _, code := range result.ErrorCodes {
+			if slices.Contains(turnstileConfigErrorCodes, code) {
+				return fmt.Errorf("%w: %v", errCaptchaUnavailable, result.ErrorCodes)
+			}
+		}
+		return fmt.Errorf("%w: %v", errCaptchaRejected, result.ErrorCodes)
+	}
+	if t.action != "" && result.Action != t.action {
+		return fmt.Errorf("%w: unexpected action %q", errCaptchaRejected, result.Action)
+	}
+	if len(t.hostnames) > 0 && !slices.Contains(t.hostnames, result.Hostname) {
+		return fmt.Errorf("%w: unexpected hostname %q", errCaptchaRejected, result.Hostname)
+	}
+	if t.cdata != "" && result.CData != t.cdata {
+		return fmt.Errorf("%w: unexpected cdata", errCaptchaRejected)
+	}
+	return nil
+}
+
+// cachedResult returns the remembered result of a token, if any.
+func (t *turnstileVerifier) cachedResult(key [sha256.Size]byte) *turnstileResult {
+	t.resultsMu.Lock()
+	defer t.resultsMu.Unlock()
+	result, ok := t.results[key]
+	if !ok || time.Now().After(result.expiresAt) {
 		return nil
 	}
-    if token == "" {
-        return fmt.Errorf("no token provided")
-    }
-    requestBody, err := json.Marshal(map[string]string{
-        "secret":   secretKey,
-        "response": token,
-        "remoteip": remoteIP,
-    })
-    if err != nil {
-        return fmt.Errorf("failed to marshal request body: %w", err)
-    }
-
-    req, err := http.NewRequestWithContext(ctx, "POST", "https://challenges.cloudflare.com/turnstile/v0/siteverify", bytes.NewBuffer(requestBody))
-    if err != nil {
-        return fmt.Errorf("failed to create request: %w", err)
-    }
-    req.Header.Set("Content-Type", "application/json")
-
-    resp, err := turnStileHttpClient.Do(req)
-    if err != nil {
-        return fmt.Errorf("failed to send request: %w", err)
-    }
-    defer resp.Body.Close()
-
-    if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("unexpected status code: %v", resp.StatusCode)
-    }
-
-    var result TurnstileResponse
-    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-        return fmt.Errorf("failed to parse response: %w", err)
-    }
-
-    if !result.Success {
-        return fmt.Errorf("turnstile validation failed: %v", result.ErrorCodes)
-    }
-
-    return nil
-}
\ No newline at end of file
+	return &result
+}
+
+// cacheResult remembers the result of a token. Accepted tokens are used up,
+// so they get rejected from then on.
+func (t *turnstileVerifier) cacheResult(key [sha256.Size]byte, err error) {
+	if err == nil {
+		err = fmt.Errorf("%w: token was already used", errCaptchaRejected)
+	}
+	t.resultsMu.Lock()
+	defer t.resultsMu.Unlock()
+	now := time.Now()
+	if t.results == nil {
+		t.results = map[[sha256.Size]byte]turnstileResult{}
+	}
+	if len(t.results) >= TURNSTILE_RESULT_CACHE_SIZE {
+		for key, result := range t.results {
+			if now.After(result.expiresAt) {
+				delete(t.results, key)
+			}
+		}
+	}
+	// Without room siteverify rejects the replays itself
+	if len(t.results) < TURNSTILE_RESULT_CACHE_SIZE {
+		t.results[key] = turnstileResult{err: err, expiresAt: now.Add(TURNSTILE_RESULT_TTL)}
+	}
+}
+
+func (t *turnstileVerifier) siteverify(ctx context.Context, request map[string]string) (*TurnstileResponse, error) {
+	requestBody, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.siteverifyURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+
+	var result TurnstileResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &result, nil
+}
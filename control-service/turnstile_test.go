@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// siteverifyServer fakes the Turnstile siteverify API. Each request gets
+// answered by the next status and response, the last ones are repeated.
+type siteverifyServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	statuses  []int
+	responses []TurnstileResponse
+	requests  []map[string]string
+}
+
+func newSiteverifyServer(t *testing.T, statuses []int, responses ...TurnstileResponse) *siteverifyServer {
+	t.Helper()
+	s := &siteverifyServer{statuses: statuses, responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("could not decode siteverify request: %v", err)
+		}
+		s.mu.Lock()
+		idx := len(s.requests)
+		s.requests = append(s.requests, request)
+		s.mu.Unlock()
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status = s.statuses[min(idx, len(s.statuses)-1)]
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(s.responses[min(idx, len(s.responses)-1)]); err != nil {
+			t.Errorf("could not encode siteverify response: %v", err)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *siteverifyServer) Requests() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func newTestTurnstileVerifier(server *siteverifyServer) *turnstileVerifier {
+	return &turnstileVerifier{
+		client:        &http.Client{Timeout: 5 * time.Second},
+		secretKey:     "secret",
+		siteverifyURL: server.URL,
+	}
+}
+
+func TestTurnstileVerifySuccess(t *testing.T) {
+	server := newSiteverifyServer(t, nil, TurnstileResponse{Success: true})
+	verifier := newTestTurnstileVerifier(server)
+	if err := verifier.Verify(context.Background(), "token", "203.0.113.1"); err != nil {
+		t.Fatalf("expected token to be accepted, got: %v", err)
+	}
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 siteverify request, got %d", len(requests))
+	}
+	request := requests[0]
+	if request["secret"] != "secret" || request["response"] != "token" || request["remoteip"] != "203.0.113.1" {
+		t.Errorf("unexpected siteverify request: %v", request)
+	}
+	if request["idempotency_key"] == "" {
+		t.Errorf("expected an idempotency key")
+	}
+}
+
+func TestTurnstileVerifyEmptyToken(t *testing.T) {
+	server := newSiteverifyServer(t, nil, TurnstileResponse{Success: true})
+	verifier := newTestTurnstileVerifier(server)
+	if err := verifier.Verify(context.Background(), "", ""); !errors.Is(err, errCaptchaRejected) {
+		t.Fatalf("expected errCaptchaRejected, got: %v", err)
+	}
+	if len(server.Requests()) != 0 {
+		t.Errorf("expected no siteverify request without a token")
+	}
+}
+
+func TestTurnstileVerifyErrorCodes(t *testing.T) {
+	tests := map[string]error{
+		"invalid-input-response": errCaptchaRejected,
+		"timeout-or-duplicate":   errCaptchaRejected,
+	}
+	for _, code := range turnstileConfigErrorCodes {
+		tests[code] = errCaptchaUnavailable
+	}
+	for code, want := range tests {
+		t.Run(code, func(t *testing.T) {
+			server := newSiteverifyServer(t, nil, TurnstileResponse{
+				Success:    false,
+				ErrorCodes: []string{code},
+			})
+			verifier := newTestTurnstileVerifier(server)
+			if err := verifier.Verify(context.Background(), "token", ""); !errors.Is(err, want) {
+				t.Fatalf("expected %v, got: %v", want, err)
+			}
+		})
+	}
+}
+
+func TestTurnstileVerifyRetry(t *testing.T) {
+	t.Run("recovers", func(t *testing.T) {
+		server := newSiteverifyServer(t, []int{http.StatusBadGateway, http.StatusOK}, TurnstileResponse{Success: true})
+		verifier := newTestTurnstileVerifier(server)
+		if err := verifier.Verify(context.Background(), "token", ""); err != nil {
+			t.Fatalf("expected token to be accepted after the retry, got: %v", err)
+		}
+		requests := server.Requests()
+		if len(requests) != 2 {
+			t.Fatalf("expected 2 siteverify requests, got %d", len(requests))
+		}
+		if requests[0]["idempotency_key"] != requests[1]["idempotency_key"] {
+			t.Errorf("expected the retry to reuse the idempotency key")
+		}
+	})
+	t.Run("fails", func(t *testing.T) {
+		server := newSiteverifyServer(t, []int{http.StatusInternalServerError})
+		verifier := newTestTurnstileVerifier(server)
+		if err := verifier.Verify(context.Background(), "token", ""); !errors.Is(err, errCaptchaUnavailable) {
+			t.Fatalf("expected errCaptchaUnavailable, got: %v", err)
+		}
+		if requests := server.Requests(); len(requests) != 2 {
+			t.Fatalf("expected 2 siteverify requests, got %d", len(requests))
+		}
+	})
+}
+
+func TestTurnstileVerifyChallenge(t *testing.T) {
+	response := TurnstileResponse{
+		Success:  true,
+		Action:   "run",
+		Hostname: "try.playwright.tech",
+		CData:    "cdata",
+	}
+	tests := []struct {
+		name      string
+		action    string
+		hostnames []string
+		cdata     string
+		want      error
+	}{
+		{name: "matching", action: "run", hostnames: []string{"localhost", "try.playwright.tech"}, cdata: "cdata"},
+		{name: "action mismatch", action: "share", want: errCaptchaRejected},
+		{name: "hostname mismatch", hostnames: []string{"localhost"}, want: errCaptchaRejected},
+		{name: "cdata mismatch", cdata: "other", want: errCaptchaRejected},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newSiteverifyServer(t, nil, response)
+			verifier := newTestTurnstileVerifier(server)
+			verifier.action = test.action
+			verifier.hostnames = test.hostnames
+			verifier.cdata = test.cdata
+			err := verifier.Verify(context.Background(), "token", "")
+			if test.want == nil && err != nil {
+				t.Fatalf("expected token to be accepted, got: %v", err)
+			}
+			if !errors.Is(err, test.want) {
+				t.Fatalf("expected %v, got: %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestTurnstileVerifyCache(t *testing.T) {
+	t.Run("rejects replayed tokens", func(t *testing.T) {
+		server := newSiteverifyServer(t, nil, TurnstileResponse{Success: true})
+		verifier := newTestTurnstileVerifier(server)
+		if err := verifier.Verify(context.Background(), "token", ""); err != nil {
+			t.Fatalf("expected token to be accepted, got: %v", err)
+		}
+		if err := verifier.Verify(context.Background(), "token", ""); !errors.Is(err, errCaptchaRejected) {
+			t.Fatalf("expected replayed token to be rejected, got: %v", err)
+		}
+		if err := verifier.Verify(context.Background(), "other", ""); err != nil {
+			t.Fatalf("expected other token to be accepted, got: %v", err)
+		}
+		if requests := server.Requests(); len(requests) != 2 {
+			t.Fatalf("expected 2 siteverify requests, got %d", len(requests))
+		}
+	})
+	t.Run("remembers rejected tokens", func(t *testing.T) {
+		server := newSiteverifyServer(t, nil, TurnstileResponse{
+			Success:    false,
+			ErrorCodes: []string{"invalid-input-response"},
+		})
+		verifier := newTestTurnstileVerifier(server)
+		for i := 0; i < 2; i++ {
+			if err := verifier.Verify(context.Background(), "token", ""); !errors.Is(err, errCaptchaRejected) {
+				t.Fatalf("expected errCaptchaRejected, got: %v", err)
+			}
+		}
+		if requests := server.Requests(); len(requests) != 1 {
+			t.Fatalf("expected 1 siteverify request, got %d", len(requests))
+		}
+	})
+	t.Run("does not remember unavailable results", func(t *testing.T) {
+		server := newSiteverifyServer(t, []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK}, TurnstileResponse{Success: true})
+		verifier := newTestTurnstileVerifier(server)
+		if err := verifier.Verify(context.Background(), "token", ""); !errors.Is(err, errCaptchaUnavailable) {
+			t.Fatalf("expected errCaptchaUnavailable, got: %v", err)
+		}
+		if err := verifier.Verify(context.Background(), "token", ""); err != nil {
+			t.Fatalf("expected token to be accepted once siteverify recovered, got: %v", err)
+		}
+	})
+}
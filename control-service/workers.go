@@ -4,44 +4,80 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	"github.com/mxschmitt/try-playwright/internal/tracing"
 	"github.com/mxschmitt/try-playwright/internal/workertypes"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/google/uuid"
 	amqp "github.com/rabbitmq/amqp091-go"
-	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/utils/ptr"
 )
 
 type Workers struct {
 	language           workertypes.WorkerLanguage
-	workers            chan *Worker
 	amqpReplyQueueName string
+	amqpConnection     *amqp.Connection
 	amqpChannel        *amqp.Channel
-	k8ClientSet        kubernetes.Interface
+	runtime            WorkerRuntime
+	images             *workerImages
 	replies            sync.Map // map[string]chan *workertypes.WorkerResponsePayload
+	outputs            sync.Map // map[string]chan *workertypes.WorkerOutputChunk
+	handles            sync.Map // map[string]*Worker, keyed by the runtime handle
+	// starting is the amount of workers which are currently being created.
+	starting atomic.Int32
+	stop     chan struct{}
+
+	mu sync.Mutex
+	// idle are the warm workers, oldest first.
+	idle []*Worker
+	// queue contains the pending Get calls.
+	queue          *fairQueue
+	maxQueueLength int
+	closed         bool
+	size           PoolSize
+	// target is the amount of warm workers which the autoscaler wants.
+	target int
+	stats  autoscalerStats
+	// draining pools have no warm workers and reject runs, drained gets
+	// closed once they start draining.
+	draining bool
+	drained  chan struct{}
+	// inFlight are the workers which got handed out for a run.
+	inFlight map[string]*Worker
+	// replaceMu makes sure only one rollout or recycle runs at a time, it has
+	// to be held while calling replaceIdle.
+	replaceMu sync.Mutex
 }
 
-func newWorkers(language workertypes.WorkerLanguage, workerCount int, k8ClientSet kubernetes.Interface, amqpChannel *amqp.Channel) (*Workers, error) {
+// newWorkers creates an empty pool, it gets filled by Replenish.
+func newWorkers(language workertypes.WorkerLanguage, size PoolSize, maxQueueLength int, runtime WorkerRuntime, images *workerImages, amqpConnection *amqp.Connection, amqpChannel *amqp.Channel) (*Workers, error) {
 	w := &Workers{
-		language:    language,
-		k8ClientSet: k8ClientSet,
-		amqpChannel: amqpChannel,
-		workers:     make(chan *Worker, workerCount),
+		language:       language,
+		queue:          newFairQueue(),
+		maxQueueLength: maxQueueLength,
+		runtime:        runtime,
+		images:         images,
+		amqpConnection: amqpConnection,
+		amqpChannel:    amqpChannel,
+		stop:           make(chan struct{}),
+		size:           size,
+		target:         size.Min,
+		stats:          autoscalerStats{lastAcquisition: time.Now()},
+		drained:        make(chan struct{}),
+		inFlight:       map[string]*Worker{},
 	}
 	if err := w.consumeReplies(); err != nil {
 		return nil, fmt.Errorf("could not consume replies: %w", err)
 	}
-
-	if err := w.AddWorkers(workerCount); err != nil {
-		return nil, fmt.Errorf("could not add initial workers: %w", err)
+	if err := runtime.Watch(language, w.stop, w.handleRuntimeEvent); err != nil {
+		return nil, fmt.Errorf("could not watch workers: %w", err)
 	}
+	go w.runAutoscaler()
 	return w, nil
 }
 
@@ -72,6 +108,10 @@ func (w *Workers) consumeReplies() error {
 	}
 	go func() {
 		for msg := range msgs {
+			if msg.Type == workertypes.WorkerMessageTypeChunk {
+				w.handleOutputChunk(msg)
+				continue
+			}
 			log.Printf("received rpc callback, corr id: %v", msg.CorrelationId)
 			value, ok := w.replies.Load(msg.CorrelationId)
 			if !ok {
@@ -90,24 +130,258 @@ func (w *Workers) consumeReplies() error {
 	return nil
 }
 
+func (w *Workers) handleOutputChunk(msg amqp.Delivery) {
+	value, ok := w.outputs.Load(msg.CorrelationId)
+	if !ok {
+		log.Printf("no output channel exists for worker %s", msg.CorrelationId)
+		return
+	}
+	var chunk *workertypes.WorkerOutputChunk
+	if err := json.Unmarshal(msg.Body, &chunk); err != nil {
+		log.Printf("could not unmarshal output chunk json: %v", err)
+		return
+	}
+	// Never block the reply consumer of all workers because of a slow
+	// subscriber, the final reply contains the full output anyways.
+	select {
+	case value.(chan *workertypes.WorkerOutputChunk) <- chunk:
+	default:
+		log.Printf("dropping output chunk for worker %s, subscriber is too slow", msg.CorrelationId)
+	}
+}
+
 func (w *Workers) AddWorkers(amount int) error {
 	for i := 0; i < amount; i++ {
-		worker, err := newWorker(w)
+		w.starting.Add(1)
+		worker, err := newWorker(w, w.images.Image(w.language))
+		w.starting.Add(-1)
 		if err != nil {
 			return fmt.Errorf("could not create new worker: %w", err)
 		}
-		w.workers <- worker
+		if !w.put(worker) {
+			if err := worker.Cleanup(); err != nil {
+				return fmt.Errorf("could not cleanup surplus worker: %w", err)
+			}
+		}
 	}
 	return nil
 }
 
-func (w *Workers) GetCh() <-chan *Worker {
-	return w.workers
+// put adds the worker to the warm pool and reports whether there was room.
+func (w *Workers) put(worker *Worker) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || w.draining || len(w.idle) >= MAX_POOL_SIZE {
+		return false
+	}
+	w.idle = append(w.idle, worker)
+	w.dispatchLocked()
+	return true
+}
+
+// dispatchLocked hands ready workers to the waiters in the order of the fair
+// queue. Workers whose process is still starting stay in the pool, dead ones
+// get replaced.
+func (w *Workers) dispatchLocked() {
+	defer w.queue.notifyPositions()
+	for w.queue.Len() > 0 {
+		idx := -1
+		for i := 0; i < len(w.idle); i++ {
+			switch health := w.idle[i].health(); health {
+			case workerHealthReady:
+				idx = i
+			case workerHealthDead:
+				go w.replace(w.idle[i])
+				w.idle = slices.Delete(w.idle, i, i+1)
+				i--
+			}
+			if idx >= 0 {
+				break
+			}
+		}
+		if idx < 0 {
+			return
+		}
+		worker := w.idle[idx]
+		w.idle = slices.Delete(w.idle, idx, idx+1)
+		w.queue.pop().worker <- worker
+	}
+}
+
+func (w *Workers) dispatch() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dispatchLocked()
+}
+
+// removeIdle removes the worker from the warm pool and reports whether it was
+// part of it.
+func (w *Workers) removeIdle(worker *Worker) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	idx := slices.Index(w.idle, worker)
+	if idx < 0 {
+		return false
+	}
+	w.idle = slices.Delete(w.idle, idx, idx+1)
+	return true
+}
+
+// replace deletes a dead worker and creates a new one instead.
+func (w *Workers) replace(worker *Worker) {
+	logger := log.WithField("worker-id", worker.id)
+	logger.Println("Replacing dead worker")
+	if err := worker.Cleanup(); err != nil {
+		logger.Printf("could not cleanup dead worker: %v", err)
+	}
+	if err := w.Replenish(); err != nil {
+		logger.Printf("could not replace dead worker: %v", err)
+	}
+}
+
+// Replenish creates workers until the warm pool reaches its target again.
+func (w *Workers) Replenish() error {
+	if w.isDraining() {
+		return nil
+	}
+	missing := w.Target() - w.warmCount() - int(w.starting.Load())
+	if missing <= 0 {
+		return nil
+	}
+	return w.AddWorkers(missing)
+}
+
+func (w *Workers) isDraining() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.draining
+}
+
+func (w *Workers) Target() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.target
+}
+
+func (w *Workers) warmCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.idle)
+}
+
+// Get waits up to timeout for a warm worker whose process is running and
+// which is consuming its queue. The waiting clients are served round-robin,
+// onPosition gets called with the position in the queue whenever it changes.
+func (w *Workers) Get(ctx context.Context, client string, timeout time.Duration, onPosition func(position int)) (*Worker, error) {
+	start := time.Now()
+	defer func() {
+		w.recordAcquisition(time.Since(start))
+	}()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	waiter := newWaiter(client)
+	w.mu.Lock()
+	if w.draining {
+		w.mu.Unlock()
+		return nil, errPoolDrained
+	}
+	drained := w.drained
+	if w.maxQueueLength > 0 && w.queue.Len() >= w.maxQueueLength {
+		w.mu.Unlock()
+		return nil, errQueueFull
+	}
+	w.queue.push(waiter, false)
+	w.dispatchLocked()
+	w.mu.Unlock()
+	for {
+		select {
+		case position := <-waiter.position:
+			if onPosition != nil {
+				onPosition(position)
+			}
+			continue
+		case worker := <-waiter.worker:
+			switch worker.consumerHealth() {
+			case workerHealthReady:
+				w.markInFlight(ctx, worker, client)
+				return worker, nil
+			case workerHealthDead:
+				go w.replace(worker)
+			default:
+				// The worker process did not connect to its queue yet, give
+				// it some time before trying again.
+				if !w.put(worker) {
+					go w.replace(worker)
+				}
+				select {
+				case <-time.After(250 * time.Millisecond):
+				case <-deadline.C:
+					return nil, errWorkerTimeout
+				case <-ctx.Done():
+					return nil, errRunCancelled
+				}
+			}
+			// Keep the place at the front of the queue of the client
+			w.mu.Lock()
+			w.queue.push(waiter, true)
+			w.dispatchLocked()
+			w.mu.Unlock()
+		case <-deadline.C:
+			w.removeWaiter(waiter)
+			return nil, errWorkerTimeout
+		case <-ctx.Done():
+			w.removeWaiter(waiter)
+			return nil, errRunCancelled
+		case <-drained:
+			w.removeWaiter(waiter)
+			return nil, errPoolDrained
+		}
+	}
+}
+
+func (w *Workers) removeWaiter(waiter *waiter) {
+	w.mu.Lock()
+	if w.queue.remove(waiter) {
+		w.queue.notifyPositions()
+	}
+	w.mu.Unlock()
+	// A worker might have been handed over in the meantime
+	select {
+	case worker := <-waiter.worker:
+		if !w.put(worker) {
+			go w.replace(worker)
+		}
+	default:
+	}
+}
+
+// PoolStatus is a snapshot of the state of a pool.
+type PoolStatus struct {
+	Queued      int `json:"queued"`
+	IdleWorkers int `json:"idleWorkers"`
+	Starting    int `json:"starting"`
+	Target      int `json:"target"`
+}
+
+func (w *Workers) Status() PoolStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return PoolStatus{
+		Queued:      w.queue.Len(),
+		IdleWorkers: len(w.idle),
+		Starting:    int(w.starting.Load()),
+		Target:      w.target,
+	}
 }
 
 func (w *Workers) Cleanup() error {
-	close(w.workers)
-	for worker := range w.workers {
+	w.mu.Lock()
+	w.closed = true
+	close(w.stop)
+	idle := w.idle
+	w.idle = nil
+	w.mu.Unlock()
+	for _, worker := range idle {
 		if err := worker.Cleanup(); err != nil {
 			return fmt.Errorf("could not cleanup worker: %w", err)
 		}
@@ -116,108 +390,67 @@ func (w *Workers) Cleanup() error {
 }
 
 type Worker struct {
-	id       string
-	workers  *Workers
-	pod      *v1.Pod
-	language workertypes.WorkerLanguage
+	id      string
+	workers *Workers
+	// handle identifies the worker process in the runtime.
+	handle    string
+	image     string
+	language  workertypes.WorkerLanguage
+	createdAt time.Time
+	// run is set once the worker got handed out.
+	run *workerRun
+	// died gets closed once the process of a handed out worker died.
+	died     chan struct{}
+	diedOnce sync.Once
 }
 
-func newWorker(workers *Workers) (*Worker, error) {
+func newWorker(workers *Workers, image string) (*Worker, error) {
 	w := &Worker{
-		id:       uuid.New().String(),
-		workers:  workers,
-		language: workers.language,
+		id:        uuid.New().String(),
+		workers:   workers,
+		image:     image,
+		language:  workers.language,
+		createdAt: time.Now(),
 	}
 
-	w.workers.replies.Store(w.id, make(chan *workertypes.WorkerResponsePayload, 1))
-
 	_, err := w.workers.amqpChannel.QueueDeclare(
 		fmt.Sprintf("rpc_queue_%s", w.id), // name
 		false,                             // durable
 		true,                              // delete when unused
 		false,                             // exclusive
 		false,                             // noWait
-		nil,                               // arguments
+		amqp.Table{ // arguments
+			"x-expires": int32(WORKER_QUEUE_EXPIRY.Milliseconds()),
+		},
 	)
 	if err != nil {
 		return nil, fmt.Errorf("could not declare worker queue: %w", err)
 	}
 
-	if err := w.createPod(); err != nil {
-		return nil, fmt.Errorf("could not create pod: %w", err)
+	start := time.Now()
+	w.handle, err = w.workers.runtime.Start(context.Background(), w)
+	workerStartDuration.WithLabelValues(string(w.language)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("could not start worker: %w", err)
 	}
+	w.workers.register(w)
 
 	return w, nil
 }
 
-func (w *Worker) createPod() error {
-	var err error
-	w.pod, err = w.workers.k8ClientSet.CoreV1().Pods(K8_NAMESPACE_NAME).Create(context.Background(), &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			GenerateName: fmt.Sprintf("worker-%s-", w.language),
-			Labels: map[string]string{
-				"role":     "worker",
-				"language": string(w.language),
-			},
-		},
-		Spec: v1.PodSpec{
-			RestartPolicy:                v1.RestartPolicy(v1.RestartPolicyNever),
-			AutomountServiceAccountToken: ptr.To(false),
-			EnableServiceLinks:           ptr.To(false),
-			Containers: []v1.Container{
-				{
-					Name:            "worker",
-					Image:           determineWorkerImageName(w.workers.language),
-					ImagePullPolicy: v1.PullIfNotPresent,
-					Env: []v1.EnvVar{
-						{
-							Name:  "WORKER_ID",
-							Value: w.id,
-						},
-						{
-							Name:  "AMQP_URL",
-							Value: "amqp://rabbitmq:5672?heartbeat=5",
-						},
-						{
-							Name:  "WORKER_HTTP_PROXY",
-							Value: "http://squid:3128",
-						},
-						{
-							Name:  "FILE_SERVICE_URL",
-							Value: "http://file:8080",
-						},
-					},
-					Resources: v1.ResourceRequirements{
-						Limits: v1.ResourceList{
-							v1.ResourceMemory:           resource.MustParse("1024Mi"),
-							v1.ResourceCPU:              resource.MustParse("1000m"),
-							v1.ResourceEphemeralStorage: resource.MustParse("512Mi"),
-						},
-						Requests: v1.ResourceList{
-							v1.ResourceMemory:           resource.MustParse("64Mi"),
-							v1.ResourceCPU:              resource.MustParse("100m"),
-							v1.ResourceEphemeralStorage: resource.MustParse("64Mi"),
-						},
-					},
-				},
-			},
-		},
-	}, metav1.CreateOptions{})
-	if err != nil {
-		return fmt.Errorf("could not create pod: %w", err)
-	}
-	return nil
-}
-
-func determineWorkerImageName(language workertypes.WorkerLanguage) string {
-	tag := os.Getenv("WORKER_IMAGE_TAG")
-	return fmt.Sprintf("ghcr.io/mxschmitt/try-playwright/worker-%s:%s", language, tag)
+// register makes the pool aware of the worker, so its replies and runtime
+// events get routed to it.
+func (w *Workers) register(worker *Worker) {
+	worker.died = make(chan struct{})
+	w.replies.Store(worker.id, make(chan *workertypes.WorkerResponsePayload, 1))
+	w.outputs.Store(worker.id, make(chan *workertypes.WorkerOutputChunk, 256))
+	w.handles.Store(worker.handle, worker)
 }
 
-func (w *Worker) Publish(code string) error {
-	msgBody, err := json.Marshal(map[string]string{
-		"code": code,
-	})
+// Publish sends the payload to the worker, the trace context of ctx gets
+// passed along in the message headers.
+func (w *Worker) Publish(ctx context.Context, payload *workertypes.WorkerRequestPayload) error {
+	msgBody, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("could not marshal json: %v", err)
 	}
@@ -230,6 +463,7 @@ func (w *Worker) Publish(code string) error {
 			ContentType:   "application/json",
 			CorrelationId: w.id,
 			ReplyTo:       w.workers.amqpReplyQueueName,
+			Headers:       logging.InjectAMQP(ctx, tracing.InjectAMQP(ctx, nil)),
 			Body:          msgBody,
 		}); err != nil {
 		return fmt.Errorf("could not publish message: %w", err)
@@ -238,13 +472,15 @@ func (w *Worker) Publish(code string) error {
 }
 
 func (w *Worker) Cleanup() error {
-	if err := w.workers.k8ClientSet.CoreV1().Pods(K8_NAMESPACE_NAME).
-		Delete(context.Background(), w.pod.Name, metav1.DeleteOptions{
-			GracePeriodSeconds: ptr.To(int64(0)),
-		}); err != nil {
-		return fmt.Errorf("could not delete pod: %w", err)
-	}
+	// Drop the reply channels first, so late replies of cancelled runs get
+	// discarded even if stopping the process fails.
 	w.workers.replies.Delete(w.id)
+	w.workers.outputs.Delete(w.id)
+	w.workers.handles.Delete(w.handle)
+	w.workers.removeInFlight(w)
+	if err := w.workers.runtime.Stop(context.Background(), w); err != nil {
+		return fmt.Errorf("could not stop worker: %w", err)
+	}
 	return nil
 }
 
@@ -258,3 +494,17 @@ func (w *Worker) Subscribe() <-chan *workertypes.WorkerResponsePayload {
 	}
 	return value.(chan *workertypes.WorkerResponsePayload)
 }
+
+// Died is closed once the process of the worker died during its run.
+func (w *Worker) Died() <-chan struct{} {
+	return w.died
+}
+
+func (w *Worker) SubscribeOutput() <-chan *workertypes.WorkerOutputChunk {
+	value, ok := w.workers.outputs.Load(w.id)
+	if !ok {
+		// Never deliver anything instead of spinning on a closed channel
+		return nil
+	}
+	return value.(chan *workertypes.WorkerOutputChunk)
+}
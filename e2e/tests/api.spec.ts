@@ -56,6 +56,35 @@ test.describe("JavaScript", () => {
   })
 })
 
+test.describe("Multiple files", () => {
+  test("can require helper modules", async ({ request }) => {
+    const resp = await request.post('/service/control/run', {
+      data: {
+        code: `console.log(require('./lib/add').add(1, 1))`,
+        language: "javascript",
+        files: {
+          "lib/add.js": "exports.add = (a, b) => a + b",
+        },
+      },
+      timeout: 30 * 1000,
+    })
+    await expect(resp).toBeOK()
+    expect(await resp.json()).toHaveProperty('output', '2')
+  })
+  test("rejects files outside of the execution directory", async ({ request }) => {
+    const resp = await request.post('/service/control/run', {
+      data: {
+        code: `console.log(1)`,
+        language: "javascript",
+        files: {
+          "../escape.js": "",
+        },
+      },
+    })
+    expect(resp.status()).toBe(400)
+  })
+})
+
 test.describe("Python", () => {
   test("can execute basic code", async ({ executeCode }) => {
     const resp = await executeCode("print(1+1)", "python")
@@ -184,4 +213,128 @@ class Program
     expect(body).toHaveProperty('files', [])
     expect(body).toHaveProperty('output', '2')
   })
-})
\ No newline at end of file
+})
+test.describe("Streaming", () => {
+  test("streams the output before the result", async ({ request }) => {
+    const resp = await request.post('/service/control/run/stream', {
+      data: {
+        code: `console.log(1 + 1)`,
+        language: "javascript"
+      },
+      timeout: 30 * 1000,
+    })
+    await expect(resp).toBeOK()
+    expect(resp.headers()['content-type']).toContain('text/event-stream')
+    const events = (await resp.text()).trim().split('\n\n').map(event => {
+      const [eventLine, dataLine] = event.split('\n')
+      return { event: eventLine.replace('event: ', ''), data: JSON.parse(dataLine.replace('data: ', '')) }
+    })
+    const outputs = events.filter(event => event.event === 'output')
+    expect(outputs.map(event => event.data.data).join('')).toBe('2\n')
+    const result = events[events.length - 1]
+    expect(result.event).toBe('result')
+    expect(result.data).toHaveProperty('success', true)
+    expect(result.data).toHaveProperty('output', '2')
+  })
+})
+
+test.describe("Jobs", () => {
+  test("can submit a job and poll its result", async ({ request }) => {
+    const resp = await request.post('/service/control/jobs', {
+      data: {
+        code: `console.log(1 + 1)`,
+        language: "javascript"
+      },
+    })
+    expect(resp.status()).toBe(202)
+    const job = await resp.json()
+    expect(job).toHaveProperty('status', 'queued')
+    await expect.poll(async () => {
+      const resp = await request.get(`/service/control/jobs/${job.id}`)
+      return (await resp.json()).status
+    }, { timeout: 30 * 1000 }).toBe('succeeded')
+    const result = await (await request.get(`/service/control/jobs/${job.id}`)).json()
+    expect(result.result).toHaveProperty('success', true)
+    expect(result.result).toHaveProperty('output', '2')
+  })
+  test("returns 404 for unknown jobs", async ({ request }) => {
+    const resp = await request.get('/service/control/jobs/does-not-exist')
+    expect(resp.status()).toBe(404)
+  })
+})
+
+test.describe("Share", () => {
+  test("can create and fetch a share", async ({ request }) => {
+    const createResp = await request.post('/service/control/share/create', {
+      data: {
+        code: `console.log(1 + 1)`,
+        language: "javascript",
+        title: "Addition",
+      },
+    })
+    expect(createResp.status()).toBe(201)
+    const { key } = await createResp.json()
+    const getResp = await request.get(`/service/control/share/get/${key}`)
+    await expect(getResp).toBeOK()
+    expect(await getResp.json()).toMatchObject({
+      schemaVersion: 1,
+      id: key,
+      code: `console.log(1 + 1)`,
+      language: "javascript",
+      title: "Addition",
+    })
+    const etag = getResp.headers()['etag']
+    expect(etag).toBeTruthy()
+    const cachedResp = await request.get(`/service/control/share/get/${key}`, {
+      headers: { 'If-None-Match': etag },
+    })
+    expect(cachedResp.status()).toBe(304)
+  })
+  test("can delete a share with its delete token", async ({ request }) => {
+    const createResp = await request.post('/service/control/share/create', {
+      data: { code: `console.log(1)`, language: "javascript", ttl: 60 },
+    })
+    const { key, deleteToken, expiresAt } = await createResp.json()
+    expect(deleteToken).toBeTruthy()
+    expect(expiresAt).toBeTruthy()
+    const forbiddenResp = await request.delete(`/service/control/share/${key}`, {
+      headers: { 'X-Delete-Token': 'invalid' },
+    })
+    expect(forbiddenResp.status()).toBe(403)
+    const deleteResp = await request.delete(`/service/control/share/${key}`, {
+      headers: { 'X-Delete-Token': deleteToken },
+    })
+    expect(deleteResp.status()).toBe(204)
+    const getResp = await request.get(`/service/control/share/get/${key}`)
+    expect(getResp.status()).toBe(404)
+  })
+  test("rejects invalid share documents", async ({ request }) => {
+    const resp = await request.post('/service/control/share/create', {
+      data: { code: `console.log(1)`, language: "cobol" },
+    })
+    expect(resp.status()).toBe(400)
+  })
+})
+
+test.describe("API keys", () => {
+  test("rejects invalid API keys", async ({ request }) => {
+    const resp = await request.post('/service/control/run', {
+      data: { code: `console.log(1)`, language: "javascript" },
+      headers: { 'Authorization': 'Bearer tpw_invalid' },
+    })
+    expect(resp.status()).toBe(401)
+    expect(await resp.json()).toEqual({ error: 'invalid API key' })
+  })
+})
+
+test.describe("Status", () => {
+  test("reports the queue of each language", async ({ request }) => {
+    const resp = await request.get('/service/control/status')
+    expect(resp.status()).toBe(200)
+    const { languages } = await resp.json()
+    for (const language of ["javascript", "python", "java", "csharp"]) {
+      expect(languages[language]).toHaveProperty('queued')
+      expect(languages[language]).toHaveProperty('idleWorkers')
+    }
+  })
+})
@@ -17,6 +17,9 @@ import (
 
 	"github.com/h2non/filetype"
 	"github.com/mxschmitt/try-playwright/internal/echoutils"
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	"github.com/mxschmitt/try-playwright/internal/minioutils"
+	"github.com/mxschmitt/try-playwright/internal/tracing"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/getsentry/sentry-go"
@@ -25,16 +28,24 @@ import (
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type server struct {
-	server      *echo.Echo
-	minioClient *minio.Client
+	server          *echo.Echo
+	metricsServer   *echo.Echo
+	minioClient     *minio.Client
+	shutdownTracing func(context.Context) error
 }
 
-const BUCKET_NAME = "file-uploads"
+const (
+	BUCKET_NAME = "file-uploads"
+	// DEFAULT_METRICS_PORT serves the metrics apart from the API, since the
+	// workers can reach the API.
+	DEFAULT_METRICS_PORT = "8081"
+)
 
 var allowedMimeTypes = []string{
 	"application/pdf",
@@ -50,48 +61,43 @@ func newServer() (*server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not init Sentry: %w", err)
 	}
-	minioClient, err := minio.New(os.Getenv("MINIO_ENDPOINT"), &minio.Options{
-		Creds:  credentials.NewStaticV4(os.Getenv("MINIO_ACCESS_KEY"), os.Getenv("MINIO_SECRET_KEY"), ""),
-		Secure: false,
-	})
+	shutdownTracing, err := tracing.Setup(context.Background(), "file-service")
 	if err != nil {
-		return nil, fmt.Errorf("could not init minio client: %w", err)
+		return nil, fmt.Errorf("could not setup tracing: %w", err)
 	}
-	err = minioClient.MakeBucket(context.Background(), BUCKET_NAME, minio.MakeBucketOptions{})
+	minioClient, err := minioutils.NewClientFromEnv()
 	if err != nil {
-		// Check to see if we already own this bucket (which happens if you run this twice)
-		exists, errBucketExists := minioClient.BucketExists(context.Background(), BUCKET_NAME)
-		if errBucketExists == nil && exists {
-			log.Printf("We already own %s\n", BUCKET_NAME)
-		} else {
-			return nil, fmt.Errorf("could not check if bucket exists: %w", err)
-		}
-	} else {
-		log.Printf("Successfully created bucket %s\n", BUCKET_NAME)
-		config := lifecycle.NewConfiguration()
-		config.Rules = []lifecycle.Rule{
-			{
-				ID:     "expire-bucket",
-				Status: "Enabled",
-				Expiration: lifecycle.Expiration{
-					Days: 1,
-				},
+		return nil, err
+	}
+	config := lifecycle.NewConfiguration()
+	config.Rules = []lifecycle.Rule{
+		{
+			ID:     "expire-bucket",
+			Status: "Enabled",
+			Expiration: lifecycle.Expiration{
+				Days: 1,
 			},
-		}
-		if err := minioClient.SetBucketLifecycle(context.Background(), BUCKET_NAME, config); err != nil {
-			return nil, fmt.Errorf("could not set bucket lifecycle rule: %w", err)
-		}
+		},
+	}
+	if err := minioutils.EnsureBucket(context.Background(), minioClient, BUCKET_NAME, config); err != nil {
+		return nil, err
 	}
 	s := &server{
-		minioClient: minioClient,
+		minioClient:     minioClient,
+		shutdownTracing: shutdownTracing,
 	}
 
 	s.server = echo.New()
 	s.server.HTTPErrorHandler = echoutils.HTTPErrorHandler(s.server)
 	s.server.Use(sentryecho.New(sentryecho.Options{}))
+	s.server.Use(echoutils.Tracing())
+	s.server.Use(echoutils.RequestLogger(nil))
 	s.server.GET("/api/v1/health", s.handleHealth)
 	s.server.HEAD("/api/v1/health", s.handleHealth)
 	s.server.POST("/api/v1/file/upload", s.handleUploadImage)
+
+	s.metricsServer = echo.New()
+	s.metricsServer.GET("/metrics", metricsHandler())
 	return s, nil
 }
 
@@ -136,16 +142,25 @@ func (s *server) processUploadedFile(ctx context.Context, fh *multipart.FileHead
 		return publicFile{}, fmt.Errorf("could not detect mime-type: %w", err)
 	}
 	if !slices.Contains(allowedMimeTypes, mimeType.MIME.Value) {
+		rejectedUploadsTotal.WithLabelValues(mimeType.MIME.Value).Inc()
 		return publicFile{}, fmt.Errorf("not allowed mime-type (%s): %s", mimeType.MIME.Value, fh.Filename)
 	}
 
 	fileExtension := filepath.Ext(fh.Filename)
 	objectName := uuid.New().String() + fileExtension
-	if _, err := s.minioClient.PutObject(ctx, BUCKET_NAME, objectName, bytes.NewBuffer(fileContent), fh.Size, minio.PutObjectOptions{
+	putCtx, span := tracing.Start(ctx, "put object", trace.WithAttributes(
+		attribute.String("object", objectName),
+		attribute.Int("size", len(fileContent)),
+	))
+	_, err = s.minioClient.PutObject(putCtx, BUCKET_NAME, objectName, bytes.NewBuffer(fileContent), fh.Size, minio.PutObjectOptions{
 		ContentType: mimeType.MIME.Value,
-	}); err != nil {
+	})
+	tracing.EndSpan(span, err)
+	if err != nil {
 		return publicFile{}, fmt.Errorf("could not put object: %w", err)
 	}
+	uploadsTotal.WithLabelValues(mimeType.MIME.Value).Inc()
+	uploadSize.WithLabelValues(mimeType.MIME.Value).Observe(float64(len(fileContent)))
 
 	publicURL, err := s.minioClient.PresignedGetObject(ctx, BUCKET_NAME, objectName, time.Minute*10, url.Values{})
 	if err != nil {
@@ -167,11 +182,28 @@ func (s *server) ListenAndServe() error {
 	return s.server.Start(fmt.Sprintf(":%s", os.Getenv("FILE_HTTP_PORT")))
 }
 
+func (s *server) ListenAndServeMetrics() error {
+	port := os.Getenv("FILE_METRICS_PORT")
+	if port == "" {
+		port = DEFAULT_METRICS_PORT
+	}
+	return s.metricsServer.Start(fmt.Sprintf(":%s", port))
+}
+
 func (s *server) Stop() error {
-	return s.server.Shutdown(context.Background())
+	if err := s.server.Shutdown(context.Background()); err != nil {
+		return fmt.Errorf("could not shutdown server: %w", err)
+	}
+	if err := s.metricsServer.Shutdown(context.Background()); err != nil {
+		return fmt.Errorf("could not shutdown metrics server: %w", err)
+	}
+	return s.shutdownTracing(context.Background())
 }
 
 func main() {
+	if err := logging.Setup("file-service"); err != nil {
+		log.Fatalf("could not setup logging: %v", err)
+	}
 	s, err := newServer()
 	if err != nil {
 		log.Fatalf("could not init server: %v", err)
@@ -184,6 +216,11 @@ func main() {
 			log.Fatalf("could not listen: %v", err)
 		}
 	}()
+	go func() {
+		if err := s.ListenAndServeMetrics(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("could not listen for metrics: %v", err)
+		}
+	}()
 	signal := <-stop
 	log.Printf("received stop signal: %s", signal)
 	log.Println("shutting down server gracefully")
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const METRICS_NAMESPACE = "try_playwright_file"
+
+var (
+	uploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "uploads_total",
+		Help:      "Uploaded files by their mime-type.",
+	}, []string{"mime_type"})
+	uploadSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "upload_size_bytes",
+		Help:      "Size of the uploaded files by their mime-type.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"mime_type"})
+	rejectedUploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "rejected_uploads_total",
+		Help:      "Uploaded files which got rejected because of their mime-type.",
+	}, []string{"mime_type"})
+)
+
+func metricsHandler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
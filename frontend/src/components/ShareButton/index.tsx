@@ -4,6 +4,7 @@ import ShareIcon from '@rsuite/icons/ShareOutline';
 import { CodeContext } from '../CodeContext'
 import styles from './index.module.css'
 import { pushNewURL } from '../../utils'
+import { CodeLanguage } from '../../constants'
 
 const ShareButton: React.FunctionComponent = () => {
     const { code, codeLanguage, examples } = useContext(CodeContext)
@@ -17,7 +18,13 @@ const ShareButton: React.FunctionComponent = () => {
         if (!example) {
             const resp = await fetch("/service/control/share/create", {
                 method: "POST",
-                body: code,
+                headers: {
+                    "Content-Type": "application/json"
+                },
+                body: JSON.stringify({
+                    code,
+                    language: codeLanguage === CodeLanguage.PLAYWRIGHT_TEST ? CodeLanguage.JAVASCRIPT : codeLanguage,
+                }),
             })
             if (!resp.ok) {
                 if (resp.status === 429) {
@@ -62,7 +62,8 @@ const fetchSharedCode = async (code: string): Promise<string | null> => {
   if (!resp.ok) {
     return null
   }
-  return await resp.text()
+  const share = await resp.json()
+  return share?.code ?? null
 }
 
 export const determineCode = async (setCode: ((code: string) => void), examples: Example[]): Promise<void> => {
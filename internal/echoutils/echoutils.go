@@ -1,12 +1,109 @@
 package echoutils
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	"github.com/mxschmitt/try-playwright/internal/tracing"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func HTTPErrorHandler(e *echo.Echo) func(err error, c echo.Context) {
 	return func(err error, c echo.Context) {
-		e.Logger.Error(err)
+		logging.FromContext(c.Request().Context()).WithError(err).Error("Request failed")
 		e.DefaultHTTPErrorHandler(err, c)
 	}
 }
+
+// Tracing starts a server span for each request which continues the trace of
+// the caller.
+func Tracing() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := tracing.ExtractHTTP(req.Context(), req.Header)
+			ctx, span := tracing.Start(ctx, fmt.Sprintf("%s %s", req.Method, c.Path()),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", req.Method),
+					attribute.String("http.route", c.Path()),
+				),
+			)
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+			err := next(c)
+			status := responseStatus(c, err)
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			return err
+		}
+	}
+}
+
+// responseStatus returns the status code of the response, which is not
+// written yet if the handler returned an error.
+func responseStatus(c echo.Context, err error) int {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	} else if err != nil {
+		return http.StatusInternalServerError
+	}
+	return c.Response().Status
+}
+
+// validRequestID restricts the request IDs which get taken over from the
+// caller, so they can't inject anything into the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestLogger attaches a logger with the request ID, the client IP and the
+// trace ID to the request context. The request ID of the caller gets reused,
+// otherwise a new one gets generated. Without clientIP the IP which echo
+// determined gets logged.
+func RequestLogger(clientIP func(c echo.Context) string) echo.MiddlewareFunc {
+	if clientIP == nil {
+		clientIP = func(c echo.Context) string {
+			return c.RealIP()
+		}
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			requestID := req.Header.Get(logging.REQUEST_ID_HEADER)
+			if !validRequestID.MatchString(requestID) {
+				requestID = uuid.New().String()
+			}
+			c.Response().Header().Set(logging.REQUEST_ID_HEADER, requestID)
+			fields := log.Fields{
+				"request-id": requestID,
+				"client-ip":  clientIP(c),
+			}
+			if spanContext := trace.SpanContextFromContext(req.Context()); spanContext.HasTraceID() {
+				fields["trace-id"] = spanContext.TraceID().String()
+			}
+			ctx := logging.WithFields(req.Context(), fields)
+			c.SetRequest(req.WithContext(ctx))
+
+			start := time.Now()
+			err := next(c)
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"method":   req.Method,
+				"route":    c.Path(),
+				"status":   responseStatus(c, err),
+				"duration": time.Since(start).Milliseconds(),
+			}).Debug("Handled request")
+			return err
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package echoutils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mxschmitt/try-playwright/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown, err := tracing.SetupWithExporter("test", exporter, tracing.WithSyncExport())
+	if err != nil {
+		t.Fatalf("could not setup tracing: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("could not shutdown tracing: %v", err)
+		}
+	})
+
+	e := echo.New()
+	e.Use(Tracing())
+	e.GET("/runs/:id", func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Param("id"))
+	})
+	e.GET("/shares/:id", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusNotFound, "share not found")
+	})
+	e.POST("/runs", func(c echo.Context) error {
+		return errors.New("worker unavailable")
+	})
+
+	tests := []struct {
+		method     string
+		target     string
+		route      string
+		status     int
+		statusCode codes.Code
+	}{
+		{method: http.MethodGet, target: "/runs/123", route: "/runs/:id", status: http.StatusOK, statusCode: codes.Unset},
+		{method: http.MethodGet, target: "/shares/abc", route: "/shares/:id", status: http.StatusNotFound, statusCode: codes.Unset},
+		{method: http.MethodPost, target: "/runs", route: "/runs", status: http.StatusInternalServerError, statusCode: codes.Error},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.target, func(t *testing.T) {
+			exporter.Reset()
+			ctx, parent := tracing.Start(context.Background(), "client", trace.WithSpanKind(trace.SpanKindClient))
+			req := httptest.NewRequest(test.method, test.target, nil)
+			tracing.InjectHTTP(ctx, req.Header)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			parent.End()
+
+			if rec.Code != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, rec.Code)
+			}
+			var server *tracetest.SpanStub
+			spans := exporter.GetSpans()
+			for i := range spans {
+				if spans[i].SpanKind == trace.SpanKindServer {
+					server = &spans[i]
+				}
+			}
+			if server == nil {
+				t.Fatalf("expected a server span, got: %v", spans)
+			}
+			if want := test.method + " " + test.route; server.Name != want {
+				t.Errorf("expected span name %q, got %q", want, server.Name)
+			}
+			if route := spanAttribute(*server, "http.route").AsString(); route != test.route {
+				t.Errorf("expected route %q, got %q", test.route, route)
+			}
+			if status := spanAttribute(*server, "http.response.status_code").AsInt64(); status != int64(test.status) {
+				t.Errorf("expected status code attribute %d, got %d", test.status, status)
+			}
+			if server.Status.Code != test.statusCode {
+				t.Errorf("expected span status %v, got %v", test.statusCode, server.Status.Code)
+			}
+			if server.Parent.SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("expected the server span to continue the trace of the caller")
+			}
+		})
+	}
+}
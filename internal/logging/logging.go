@@ -0,0 +1,179 @@
+// Package logging configures the structured logger which all services share
+// and carries the fields of a request, like its ID, through the context.
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// REQUEST_ID_HEADER carries the request ID between the services, both as
+	// HTTP and as AMQP header.
+	REQUEST_ID_HEADER = "X-Request-ID"
+	// DEFAULT_LOG_CODE_MAX_LENGTH is how many characters of the code get
+	// logged in the truncate mode.
+	DEFAULT_LOG_CODE_MAX_LENGTH = 200
+)
+
+// The modes of LOG_CODE which decide how much of the user code gets logged.
+const (
+	logCodeRedact   = "redact"
+	logCodeTruncate = "truncate"
+	logCodeFull     = "full"
+)
+
+var (
+	logCode          = logCodeRedact
+	logCodeMaxLength = DEFAULT_LOG_CODE_MAX_LENGTH
+)
+
+// Setup configures the standard logrus logger via LOG_LEVEL (info by default)
+// and LOG_FORMAT (text or json) and adds the service name to all entries.
+func Setup(service string) error {
+	level := log.InfoLevel
+	if levelEnv := os.Getenv("LOG_LEVEL"); levelEnv != "" {
+		var err error
+		level, err = log.ParseLevel(levelEnv)
+		if err != nil {
+			return fmt.Errorf("could not parse 'LOG_LEVEL' env var: %w", err)
+		}
+	}
+	log.SetLevel(level)
+
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{
+			TimestampFormat: time.StampMilli,
+		})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		})
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	switch mode := os.Getenv("LOG_CODE"); mode {
+	case "":
+		logCode = logCodeRedact
+	case logCodeRedact, logCodeTruncate, logCodeFull:
+		logCode = mode
+	default:
+		return fmt.Errorf("unknown 'LOG_CODE' mode: %s", mode)
+	}
+	if maxLengthEnv := os.Getenv("LOG_CODE_MAX_LENGTH"); maxLengthEnv != "" {
+		maxLength, err := strconv.Atoi(maxLengthEnv)
+		if err != nil || maxLength <= 0 {
+			return fmt.Errorf("could not parse 'LOG_CODE_MAX_LENGTH' env var: %s", maxLengthEnv)
+		}
+		logCodeMaxLength = maxLength
+	}
+
+	log.AddHook(serviceHook(service))
+	return nil
+}
+
+// serviceHook adds the name of the service to every entry, so the entries of
+// all services can be told apart once they got collected.
+type serviceHook string
+
+func (h serviceHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h serviceHook) Fire(entry *log.Entry) error {
+	if _, ok := entry.Data["service"]; !ok {
+		entry.Data["service"] = string(h)
+	}
+	return nil
+}
+
+type loggerKey struct{}
+
+// FromContext returns the logger with the fields which got attached to ctx.
+func FromContext(ctx context.Context) *log.Entry {
+	if logger, ok := ctx.Value(loggerKey{}).(*log.Entry); ok {
+		return logger.WithContext(ctx)
+	}
+	return log.NewEntry(log.StandardLogger()).WithContext(ctx)
+}
+
+// WithFields returns a context whose logger has the given fields in addition
+// to the ones of ctx.
+func WithFields(ctx context.Context, fields log.Fields) context.Context {
+	return context.WithValue(ctx, loggerKey{}, FromContext(ctx).WithFields(fields))
+}
+
+// Detach returns a context which keeps the logger of ctx but not its
+// cancellation, for work which outlives the request.
+func Detach(ctx context.Context) context.Context {
+	if logger, ok := ctx.Value(loggerKey{}).(*log.Entry); ok {
+		return context.WithValue(context.Background(), loggerKey{}, logger)
+	}
+	return context.Background()
+}
+
+// RequestID returns the ID of the request which ctx belongs to.
+func RequestID(ctx context.Context) string {
+	if logger, ok := ctx.Value(loggerKey{}).(*log.Entry); ok {
+		if requestID, ok := logger.Data["request-id"].(string); ok {
+			return requestID
+		}
+	}
+	return ""
+}
+
+// InjectAMQP adds the request ID of ctx to the headers of an AMQP message.
+func InjectAMQP(ctx context.Context, headers amqp.Table) amqp.Table {
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	if requestID := RequestID(ctx); requestID != "" {
+		headers[REQUEST_ID_HEADER] = requestID
+	}
+	return headers
+}
+
+// ExtractAMQP returns a context whose logger has the request ID of the AMQP
+// message.
+func ExtractAMQP(ctx context.Context, headers amqp.Table) context.Context {
+	if requestID, ok := headers[REQUEST_ID_HEADER].(string); ok && requestID != "" {
+		return WithFields(ctx, log.Fields{"request-id": requestID})
+	}
+	return ctx
+}
+
+// CodeFields describes the user code for the logs. Unless LOG_CODE says
+// otherwise only its length and hash get logged, since it might contain
+// credentials.
+func CodeFields(code string) log.Fields {
+	hash := sha256.Sum256([]byte(code))
+	fields := log.Fields{
+		"code-length": len(code),
+		"code-sha256": hex.EncodeToString(hash[:])[:12],
+	}
+	switch logCode {
+	case logCodeFull:
+		fields["code"] = code
+	case logCodeTruncate:
+		fields["code"] = truncate(code, logCodeMaxLength)
+	}
+	return fields
+}
+
+func truncate(s string, maxLength int) string {
+	runes := []rune(s)
+	if len(runes) <= maxLength {
+		return s
+	}
+	return string(runes[:maxLength]) + "…"
+}
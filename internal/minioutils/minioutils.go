@@ -0,0 +1,47 @@
+package minioutils
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	log "github.com/sirupsen/logrus"
+)
+
+// NewClientFromEnv creates a minio client based on the MINIO_ENDPOINT,
+// MINIO_ACCESS_KEY and MINIO_SECRET_KEY env vars.
+func NewClientFromEnv() (*minio.Client, error) {
+	minioClient, err := minio.New(os.Getenv("MINIO_ENDPOINT"), &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("MINIO_ACCESS_KEY"), os.Getenv("MINIO_SECRET_KEY"), ""),
+		Secure: false,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not init minio client: %w", err)
+	}
+	return minioClient, nil
+}
+
+// EnsureBucket creates the bucket if it does not exist yet. The lifecycle
+// configuration gets applied to newly created buckets if it is set.
+func EnsureBucket(ctx context.Context, minioClient *minio.Client, bucketName string, lifecycleConfig *lifecycle.Configuration) error {
+	err := minioClient.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
+	if err != nil {
+		// Check to see if we already own this bucket (which happens if you run this twice)
+		exists, errBucketExists := minioClient.BucketExists(ctx, bucketName)
+		if errBucketExists == nil && exists {
+			log.Printf("We already own %s\n", bucketName)
+			return nil
+		}
+		return fmt.Errorf("could not check if bucket exists: %w", err)
+	}
+	log.Printf("Successfully created bucket %s\n", bucketName)
+	if lifecycleConfig != nil {
+		if err := minioClient.SetBucketLifecycle(ctx, bucketName, lifecycleConfig); err != nil {
+			return fmt.Errorf("could not set bucket lifecycle rule: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Package tracing sets up OpenTelemetry tracing and propagates the trace
+// context between the services via HTTP and AMQP headers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/mxschmitt/try-playwright"
+
+// Setup installs the global tracer provider which exports the spans via OTLP
+// to OTEL_EXPORTER_OTLP_ENDPOINT. Without an endpoint no spans get recorded,
+// but the trace context still gets propagated. The returned function flushes
+// and stops the exporter.
+func Setup(ctx context.Context, serviceName string, opts ...Option) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create otlp exporter: %w", err)
+	}
+	return SetupWithExporter(serviceName, exporter, opts...)
+}
+
+type config struct {
+	syncExport bool
+}
+
+type Option func(*config)
+
+// WithSyncExport exports each span as soon as it ends instead of batching
+// them, for processes which might get killed right after their work is done.
+func WithSyncExport() Option {
+	return func(c *config) {
+		c.syncExport = true
+	}
+}
+
+// SetupWithExporter installs the global tracer provider with the given
+// exporter, e.g. an in-memory one in tests.
+func SetupWithExporter(serviceName string, exporter sdktrace.SpanExporter, opts ...Option) (func(context.Context) error, error) {
+	cfg := &config{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		serviceName = name
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", serviceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("could not create resource: %w", err)
+	}
+	processor := sdktrace.NewBatchSpanProcessor(exporter)
+	if cfg.syncExport {
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Start starts a span with the tracer of the project.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// EndSpan records the error on the span, if any, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// AMQPHeaderCarrier adapts the headers of an AMQP message to a
+// propagation.TextMapCarrier.
+type AMQPHeaderCarrier amqp.Table
+
+func (c AMQPHeaderCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c AMQPHeaderCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c AMQPHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// InjectAMQP returns the headers with the trace context of ctx added.
+func InjectAMQP(ctx context.Context, headers amqp.Table) amqp.Table {
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, AMQPHeaderCarrier(headers))
+	return headers
+}
+
+// ExtractAMQP returns ctx with the trace context of the headers.
+func ExtractAMQP(ctx context.Context, headers amqp.Table) context.Context {
+	if headers == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, AMQPHeaderCarrier(headers))
+}
+
+// InjectHTTP adds the trace context of ctx to the headers of a request.
+func InjectHTTP(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// ExtractHTTP returns ctx with the trace context of the request headers.
+func ExtractHTTP(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,80 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func setupTestTracing(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown, err := SetupWithExporter("test", exporter, WithSyncExport())
+	if err != nil {
+		t.Fatalf("could not setup tracing: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("could not shutdown tracing: %v", err)
+		}
+	})
+	return exporter
+}
+
+// expectPropagated checks that a span started from the extracted context
+// continues the trace of parent.
+func expectPropagated(t *testing.T, exporter *tracetest.InMemoryExporter, parent trace.Span, extracted context.Context) {
+	t.Helper()
+	remote := trace.SpanContextFromContext(extracted)
+	if !remote.IsRemote() {
+		t.Errorf("expected the extracted span context to be remote")
+	}
+	if remote.TraceID() != parent.SpanContext().TraceID() {
+		t.Fatalf("expected trace ID %s, got %s", parent.SpanContext().TraceID(), remote.TraceID())
+	}
+	_, child := Start(extracted, "child")
+	child.End()
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("expected the child span to have the parent span %s, got %s", parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	}
+}
+
+func TestAMQPPropagation(t *testing.T) {
+	exporter := setupTestTracing(t)
+	ctx, parent := Start(context.Background(), "publish", trace.WithSpanKind(trace.SpanKindProducer))
+	defer parent.End()
+	headers := InjectAMQP(ctx, nil)
+	if _, ok := headers["traceparent"]; !ok {
+		t.Fatalf("expected traceparent header, got: %v", headers)
+	}
+	expectPropagated(t, exporter, parent, ExtractAMQP(context.Background(), headers))
+}
+
+func TestHTTPPropagation(t *testing.T) {
+	exporter := setupTestTracing(t)
+	ctx, parent := Start(context.Background(), "request", trace.WithSpanKind(trace.SpanKindClient))
+	defer parent.End()
+	header := http.Header{}
+	InjectHTTP(ctx, header)
+	if header.Get("traceparent") == "" {
+		t.Fatalf("expected traceparent header, got: %v", header)
+	}
+	expectPropagated(t, exporter, parent, ExtractHTTP(context.Background(), header))
+}
+
+func TestExtractWithoutHeaders(t *testing.T) {
+	setupTestTracing(t)
+	if ctx := ExtractAMQP(context.Background(), nil); trace.SpanContextFromContext(ctx).IsValid() {
+		t.Errorf("expected no span context without AMQP headers")
+	}
+	if ctx := ExtractHTTP(context.Background(), http.Header{}); trace.SpanContextFromContext(ctx).IsValid() {
+		t.Errorf("expected no span context without HTTP headers")
+	}
+}
@@ -2,12 +2,12 @@ package worker
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"sync"
 
 	"github.com/bmatcuk/doublestar"
 	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
 )
 
 type filesCollector struct {
@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+)
+
+// outputRecorder records the output of all executed commands, combined, per
+// stream and as an interleaved timeline. Stdout and stderr get copied by
+// different goroutines, so all writes are synchronized.
+type outputRecorder struct {
+	mu       sync.Mutex
+	combined bytes.Buffer
+	streams  map[string]*bytes.Buffer
+	timeline []workertypes.WorkerOutputChunk
+}
+
+func newOutputRecorder() *outputRecorder {
+	return &outputRecorder{
+		streams:  map[string]*bytes.Buffer{},
+		timeline: []workertypes.WorkerOutputChunk{},
+	}
+}
+
+func (r *outputRecorder) Writer(stream string) io.Writer {
+	return &outputRecorderWriter{recorder: r, stream: stream}
+}
+
+func (r *outputRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.combined.String()
+}
+
+func (r *outputRecorder) Stream(stream string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if buf, ok := r.streams[stream]; ok {
+		return buf.String()
+	}
+	return ""
+}
+
+func (r *outputRecorder) Timeline() []workertypes.WorkerOutputChunk {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.timeline
+}
+
+type outputRecorderWriter struct {
+	recorder *outputRecorder
+	stream   string
+}
+
+func (o *outputRecorderWriter) Write(p []byte) (int, error) {
+	r := o.recorder
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.combined.Write(p)
+	if _, ok := r.streams[o.stream]; !ok {
+		r.streams[o.stream] = new(bytes.Buffer)
+	}
+	r.streams[o.stream].Write(p)
+	r.timeline = append(r.timeline, workertypes.WorkerOutputChunk{
+		Stream:    o.stream,
+		Data:      string(p),
+		Timestamp: time.Now(),
+	})
+	return len(p), nil
+}
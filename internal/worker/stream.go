@@ -0,0 +1,57 @@
+package worker
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/mxschmitt/try-playwright/internal/workertypes"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// outputStreamWriter publishes everything which gets written to it as an
+// output chunk to the reply queue of the currently processed message.
+type outputStreamWriter struct {
+	channel  *amqp.Channel
+	delivery *amqp.Delivery
+	stream   string
+}
+
+func (o *outputStreamWriter) Write(p []byte) (int, error) {
+	body, err := json.Marshal(&workertypes.WorkerOutputChunk{
+		Stream:    o.stream,
+		Data:      string(p),
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Failing to stream should not fail the execution, the final response
+	// contains the full output anyways.
+	if err := o.channel.Publish(
+		"",                 // exchange
+		o.delivery.ReplyTo, // routing key
+		false,              // mandatory
+		false,              // immediate
+		amqp.Publishing{
+			ContentType:   "application/json",
+			Type:          workertypes.WorkerMessageTypeChunk,
+			CorrelationId: o.delivery.CorrelationId,
+			Body:          body,
+		}); err != nil {
+		log.Printf("could not publish output chunk: %v", err)
+	}
+	return len(p), nil
+}
+
+func (w *Worker) outputStream(stream string) io.Writer {
+	if w.streamDelivery == nil {
+		return io.Discard
+	}
+	return &outputStreamWriter{
+		channel:  w.channel,
+		delivery: w.streamDelivery,
+		stream:   stream,
+	}
+}
@@ -2,36 +2,64 @@ package worker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/mxschmitt/try-playwright/internal/logging"
+	"github.com/mxschmitt/try-playwright/internal/tracing"
 	"github.com/mxschmitt/try-playwright/internal/workertypes"
 	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sys/unix"
 )
 
 type executionHandler func(worker *Worker, code string) error
 
+var errExecutionTimeout = errors.New("Execution timeout!")
+
 type Worker struct {
+	// ctx is done once the execution timeout of the request is exceeded.
+	ctx     context.Context
 	options *WorkerExecutionOptions
 	channel *amqp.Channel
 	TmpDir  string
-	output  *bytes.Buffer
+	output  *outputRecorder
 	files   []string
 	env     []string
+	// projectFiles are the paths of the additional files of the request.
+	projectFiles []string
+	// exitCode and signal describe how the last executed command exited.
+	exitCode int
+	signal   string
+	// streamDelivery is set when the incoming message requested its output
+	// to be streamed.
+	streamDelivery *amqp.Delivery
 }
 
 var queue_name = fmt.Sprintf("rpc_queue_%s", os.Getenv("WORKER_ID"))
 
 func (w *Worker) Run() {
+	if err := logging.Setup("worker"); err != nil {
+		log.Fatalf("could not setup logging: %v", err)
+	}
+	w.ctx = logging.WithFields(w.ctx, log.Fields{
+		"worker-id": os.Getenv("WORKER_ID"),
+		"language":  os.Getenv("WORKER_LANGUAGE"),
+	})
+
 	if w.options.ExecutionDirectory != "" {
 		w.TmpDir = w.options.ExecutionDirectory
 	} else {
@@ -42,6 +70,13 @@ func (w *Worker) Run() {
 		}
 	}
 
+	// The pod gets deleted right after the reply, so export spans right away
+	shutdownTracing, err := tracing.Setup(context.Background(), "worker", tracing.WithSyncExport())
+	if err != nil {
+		log.Fatalf("could not setup tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	conn, err := amqp.Dial(os.Getenv("AMQP_URL"))
 	if err != nil {
 		log.Fatalf("could not dial to amqp: %v", err)
@@ -73,7 +108,15 @@ func (w *Worker) Run() {
 func (w *Worker) AddEnv(key, value string) {
 	w.env = append(w.env, fmt.Sprintf("%s=%s", key, value))
 }
-func (w *Worker) ExecCommand(name string, args ...string) error {
+func (w *Worker) ExecCommand(name string, args ...string) (err error) {
+	_, span := tracing.Start(w.ctx, "exec "+name)
+	defer func() {
+		span.SetAttributes(attribute.Int("exit_code", w.exitCode))
+		if w.signal != "" {
+			span.SetAttributes(attribute.String("signal", w.signal))
+		}
+		tracing.EndSpan(span, err)
+	}()
 	path, err := exec.LookPath(name)
 	if err != nil {
 		return fmt.Errorf("could not command lookup path: %w", err)
@@ -100,16 +143,27 @@ func (w *Worker) ExecCommand(name string, args ...string) error {
 		env = append(env, e...)
 	}
 
-	c := exec.Cmd{
-		Dir:    w.TmpDir,
-		Path:   path,
-		Args:   append([]string{name}, args...),
-		Stdout: io.MultiWriter(os.Stdout, w.output),
-		Stderr: io.MultiWriter(os.Stderr, w.output),
-		Env:    env,
+	c := exec.CommandContext(w.ctx, path, args...)
+	c.Args[0] = name
+	c.Dir = w.TmpDir
+	c.Stdout = io.MultiWriter(os.Stdout, w.output.Writer("stdout"), w.outputStream("stdout"))
+	c.Stderr = io.MultiWriter(os.Stderr, w.output.Writer("stderr"), w.outputStream("stderr"))
+	c.Env = env
+	// Run the command in its own process group, so the browsers which it
+	// launched get killed as well once the timeout is exceeded.
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
 	}
-	if err := c.Run(); err != nil {
-		return errors.New("could not run command")
+	// Don't wait forever on orphaned processes which still hold the pipes
+	c.WaitDelay = 5 * time.Second
+	err = c.Run()
+	w.recordExitStatus(c.ProcessState)
+	if err != nil {
+		if errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+			return errExecutionTimeout
+		}
+		return fmt.Errorf("could not run command: %w", err)
 	}
 	files, err := collector.Collect()
 	if err != nil {
@@ -119,24 +173,88 @@ func (w *Worker) ExecCommand(name string, args ...string) error {
 	return nil
 }
 
+func (w *Worker) recordExitStatus(state *os.ProcessState) {
+	if state == nil {
+		// The command could not be started
+		w.exitCode, w.signal = -1, ""
+		return
+	}
+	w.exitCode, w.signal = state.ExitCode(), ""
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		w.signal = unix.SignalName(status.Signal())
+	}
+}
+
 func (w *Worker) consumeMessage(incomingMessages <-chan amqp.Delivery) error {
 	incomingMessage := <-incomingMessages
 	var incomingMessageParsed *workertypes.WorkerRequestPayload
+	ctx := logging.ExtractAMQP(w.ctx, incomingMessage.Headers)
+	ctx, span := tracing.Start(tracing.ExtractAMQP(ctx, incomingMessage.Headers), "process message",
+		trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+	w.ctx = ctx
+	// Don't report the exit status of a previous message if no command runs
+	w.exitCode, w.signal = -1, ""
 	if err := json.Unmarshal(incomingMessage.Body, &incomingMessageParsed); err != nil {
 		return fmt.Errorf("could not parse incoming amqp message: %w", err)
 	}
+	logger := logging.FromContext(ctx)
+	logger.WithFields(logging.CodeFields(incomingMessageParsed.Code)).Info("Received job")
+	start := time.Now()
+	if incomingMessageParsed.Stream {
+		w.streamDelivery = &incomingMessage
+	}
+	if incomingMessageParsed.Timeout > 0 {
+		var cancel context.CancelFunc
+		w.ctx, cancel = context.WithTimeout(w.ctx, time.Duration(incomingMessageParsed.Timeout)*time.Millisecond)
+		defer cancel()
+	}
 	outgoingMessage := &workertypes.WorkerResponsePayload{Version: os.Getenv("PLAYWRIGHT_VERSION")}
-	if err := w.options.Handler(w, incomingMessageParsed.Code); err != nil {
+	if err := w.writeProjectFiles(incomingMessageParsed); err != nil {
 		outgoingMessage.Success = false
 		outgoingMessage.Error = err.Error()
+	} else if err := w.options.Handler(w, incomingMessageParsed.Code); err != nil {
+		outgoingMessage.Success = false
+		outgoingMessage.Error = err.Error()
+		// Handlers might wrap the error, so rely on the context instead
+		if errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+			outgoingMessage.TimedOut = true
+			outgoingMessage.Error = errExecutionTimeout.Error()
+		}
 	} else {
 		outgoingMessage.Success = true
-		outgoingMessage.Files, err = w.uploadFiles()
+		outgoingMessage.Files, err = w.uploadFiles(ctx)
 		if err != nil {
 			return fmt.Errorf("could not upload files: %w", err)
 		}
 	}
 	outgoingMessage.Output = w.options.TransformOutput(w.output.String())
+	outgoingMessage.Stdout = w.options.TransformOutput(w.output.Stream("stdout"))
+	outgoingMessage.Stderr = w.options.TransformOutput(w.output.Stream("stderr"))
+	outgoingMessage.Timeline = w.output.Timeline()
+	outgoingMessage.ExitCode = w.exitCode
+	outgoingMessage.Signal = w.signal
+	span.SetAttributes(attribute.Bool("success", outgoingMessage.Success))
+	logger.WithFields(log.Fields{
+		"success":   outgoingMessage.Success,
+		"exit-code": outgoingMessage.ExitCode,
+		"duration":  time.Since(start).Milliseconds(),
+	}).Info("Finished job")
+	if err := w.reply(ctx, &incomingMessage, outgoingMessage); err != nil {
+		return err
+	}
+
+	if err := incomingMessage.Ack(false); err != nil {
+		return fmt.Errorf("could not ack message: %w", err)
+	}
+	return nil
+}
+
+func (w *Worker) reply(ctx context.Context, incomingMessage *amqp.Delivery, outgoingMessage *workertypes.WorkerResponsePayload) (err error) {
+	_, span := tracing.Start(ctx, "reply", trace.WithSpanKind(trace.SpanKindProducer))
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
 	outgoingMessageBody, err := json.Marshal(outgoingMessage)
 	if err != nil {
 		return fmt.Errorf("could not marshal outgoing message payload: %w", err)
@@ -148,22 +266,58 @@ func (w *Worker) consumeMessage(incomingMessages <-chan amqp.Delivery) error {
 		false,                   // immediate
 		amqp.Publishing{
 			ContentType:   "application/json",
+			Type:          workertypes.WorkerMessageTypeResult,
 			CorrelationId: incomingMessage.CorrelationId,
 			Body:          outgoingMessageBody,
 		})
 	if err != nil {
 		return fmt.Errorf("could not publish message: %w", err)
 	}
+	return nil
+}
 
-	if err := incomingMessage.Ack(false); err != nil {
-		return fmt.Errorf("could not ack message: %w", err)
+// writeProjectFiles writes the additional files of the request into the
+// execution directory. All writes go through an os.Root, so neither the paths
+// nor symlinks can escape the execution directory.
+func (w *Worker) writeProjectFiles(payload *workertypes.WorkerRequestPayload) error {
+	if err := payload.ValidateFiles(); err != nil {
+		return err
+	}
+	if len(payload.Files) == 0 {
+		return nil
+	}
+	root, err := os.OpenRoot(w.TmpDir)
+	if err != nil {
+		return fmt.Errorf("could not open execution directory: %w", err)
+	}
+	defer root.Close()
+	for name, content := range payload.Files {
+		if err := root.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return fmt.Errorf("could not create directory for %s: %w", name, err)
+		}
+		if err := root.WriteFile(name, []byte(content), 0644); err != nil {
+			return fmt.Errorf("could not write file %s: %w", name, err)
+		}
+		w.projectFiles = append(w.projectFiles, filepath.Join(w.TmpDir, name))
 	}
 	return nil
 }
 
+// ProjectFiles returns the absolute paths of the additional files which got
+// passed with the request.
+func (w *Worker) ProjectFiles() []string {
+	return w.projectFiles
+}
+
 var uploadFilesEndpoint = fmt.Sprintf("%s/api/v1/file/upload", os.Getenv("FILE_SERVICE_URL"))
 
-func (w *Worker) uploadFiles() ([]workertypes.File, error) {
+func (w *Worker) uploadFiles(ctx context.Context) (files []workertypes.File, err error) {
+	ctx, span := tracing.Start(ctx, "upload files", trace.WithAttributes(
+		attribute.Int("files", len(w.files)),
+	))
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
 	var b bytes.Buffer
 	requestWriter := multipart.NewWriter(&b)
 	for i, filePath := range w.files {
@@ -175,11 +329,12 @@ func (w *Worker) uploadFiles() ([]workertypes.File, error) {
 		return nil, fmt.Errorf("could not close multipart.Writer: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", uploadFilesEndpoint, &b)
+	req, err := http.NewRequestWithContext(ctx, "POST", uploadFilesEndpoint, &b)
 	if err != nil {
 		return nil, fmt.Errorf("could not create new request: %w", err)
 	}
 	req.Header.Set("Content-Type", requestWriter.FormDataContentType())
+	tracing.InjectHTTP(ctx, req.Header)
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -224,8 +379,9 @@ func NewWorker(options *WorkerExecutionOptions) *Worker {
 		options.TransformOutput = DefaultTransformOutput
 	}
 	return &Worker{
+		ctx:     context.Background(),
 		options: options,
-		output:  new(bytes.Buffer),
+		output:  newOutputRecorder(),
 		files:   make([]string, 0),
 		env:     make([]string, 0),
 	}
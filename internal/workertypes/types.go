@@ -1,6 +1,17 @@
 package workertypes
 
-import "slices"
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	MAX_PROJECT_FILES      = 50
+	MAX_PROJECT_FILES_SIZE = 1 << 20
+)
 
 type File struct {
 	PublicURL string `json:"publicURL"`
@@ -15,14 +26,67 @@ type WorkerResponsePayload struct {
 	Duration int64  `json:"duration"`
 	Files    []File `json:"files"`
 	Output   string `json:"output"`
+	// TimedOut is set when the worker killed the execution because it ran
+	// longer than the timeout of the request.
+	TimedOut bool `json:"timedOut"`
+	// ExitCode and Signal describe how the last executed command exited,
+	// Signal is only set if it got terminated by one (e.g. SIGKILL on OOM).
+	// ExitCode is -1 if no command could be run.
+	ExitCode int                 `json:"exitCode"`
+	Signal   string              `json:"signal,omitempty"`
+	Stdout   string              `json:"stdout"`
+	Stderr   string              `json:"stderr"`
+	Timeline []WorkerOutputChunk `json:"timeline"`
 }
 
 type WorkerRequestPayload struct {
 	Token    string         `json:"token"`
 	Code     string         `json:"code"`
 	Language WorkerLanguage `json:"language"`
+	// Stream tells the worker to publish its output incrementally as
+	// WorkerOutputChunk messages before the final WorkerResponsePayload.
+	Stream bool `json:"stream,omitempty"`
+	// Files are additional project files (e.g. helper modules or page
+	// objects) keyed by their path relative to the execution directory.
+	Files map[string]string `json:"files,omitempty"`
+	// Timeout is the execution timeout in milliseconds which gets enforced
+	// by the worker, zero means no timeout.
+	Timeout int64 `json:"timeout,omitempty"`
+}
+
+// ValidateFiles checks the additional project files against the limits and
+// rejects paths which would escape the execution directory.
+func (p *WorkerRequestPayload) ValidateFiles() error {
+	if len(p.Files) > MAX_PROJECT_FILES {
+		return fmt.Errorf("too many files, at most %d are allowed", MAX_PROJECT_FILES)
+	}
+	size := 0
+	for name, content := range p.Files {
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid file path: %s", name)
+		}
+		size += len(content)
+	}
+	if size > MAX_PROJECT_FILES_SIZE {
+		return errors.New("files are too large")
+	}
+	return nil
 }
 
+// WorkerOutputChunk is a piece of stdout/stderr output which gets published
+// by the worker while the command is still running.
+type WorkerOutputChunk struct {
+	Stream    string    `json:"stream"`
+	Data      string    `json:"data"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// AMQP message types which are used to distinguish the replies of a worker.
+const (
+	WorkerMessageTypeChunk  = "chunk"
+	WorkerMessageTypeResult = "result"
+)
+
 type WorkerLanguage string
 
 const (
@@ -13,6 +13,10 @@ spec:
     metadata:
       labels:
         io.kompose.service: control
+      annotations:
+        prometheus.io/scrape: "true"
+        prometheus.io/port: "8080"
+        prometheus.io/path: /metrics
     spec:
       serviceAccountName: control-user
       containers:
@@ -21,6 +25,8 @@ spec:
               value: "${WORKER_COUNT}"
             - name: CONTROL_HTTP_PORT
               value: "8080"
+            - name: LOG_FORMAT
+              value: json
             - name: ETCD_ENDPOINT
               value: etcd:2379
             - name: AMQP_URL
@@ -31,6 +37,10 @@ spec:
               value: ${DOCKER_TAG}
             - name: TURNSTILE_SECRET_KEY
               value: "${TURNSTILE_SECRET_KEY}"
+            - name: ADMIN_TOKEN
+              value: "${ADMIN_TOKEN}"
+            - name: AUDIT_HASH_KEY
+              value: "${AUDIT_HASH_KEY}"
           image: ghcr.io/mxschmitt/try-playwright/control-service:${DOCKER_TAG}
           name: control
           imagePullPolicy: IfNotPresent
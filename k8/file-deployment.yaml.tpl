@@ -14,11 +14,19 @@ spec:
       labels:
         io.kompose.service: file
         reachable-by-worker: "true"
+      annotations:
+        prometheus.io/scrape: "true"
+        prometheus.io/port: "8081"
+        prometheus.io/path: /metrics
     spec:
       containers:
         - env:
             - name: FILE_HTTP_PORT
               value: "8080"
+            - name: FILE_METRICS_PORT
+              value: "8081"
+            - name: LOG_FORMAT
+              value: json
             - name: MINIO_ENDPOINT
               value: minio:9000
             - name: MINIO_ACCESS_KEY
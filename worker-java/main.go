@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -11,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/mxschmitt/try-playwright/internal/worker"
+	log "github.com/sirupsen/logrus"
 )
 
 var projectDir = "/home/pwuser/project/"
@@ -31,7 +31,13 @@ func handler(w *worker.Worker, code string) error {
 	if err := os.WriteFile(sourceFile, []byte(code), 0644); err != nil {
 		return fmt.Errorf("could not write Java source files: %v", err)
 	}
-	if err := w.ExecCommand("javac", "-proc:none", "--class-path", classPath, sourceFile); err != nil {
+	sourceFiles := []string{sourceFile}
+	for _, projectFile := range w.ProjectFiles() {
+		if filepath.Ext(projectFile) == ".java" && projectFile != sourceFile {
+			sourceFiles = append(sourceFiles, projectFile)
+		}
+	}
+	if err := w.ExecCommand("javac", append([]string{"-proc:none", "--class-path", classPath}, sourceFiles...)...); err != nil {
 		return fmt.Errorf("could not compile: %w", err)
 	}
 	return w.ExecCommand("java", "--class-path", classPath, filepath.Join("org", "example", className))